@@ -0,0 +1,237 @@
+package https
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// the minimum time the addresses of an upstream host are cached, so that
+	// records with small TTLs don't make every connection wait for the bootstrap servers
+	bootstrapMinTTL = 30 * time.Second
+	// how often the addresses that are about to expire are resolved again
+	bootstrapRefreshInterval = 5 * time.Second
+	bootstrapTimeout         = 2 * time.Second
+)
+
+var errBootstrapNoAddrs = errors.New("no addresses")
+
+// bootstrapResolver resolves the hostnames of upstreams with plain DNS servers instead of
+// the system resolver, which may point to this very server. The addresses are cached according
+// to their TTL and resolved again in the background before they expire. Expired addresses
+// are used until the hostname is resolved again successfully.
+type bootstrapResolver struct {
+	servers  []string
+	exchange func(ctx context.Context, m *dns.Msg, server string) (*dns.Msg, error)
+
+	mu    sync.RWMutex
+	hosts map[string]*bootstrapEntry
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+type bootstrapEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// newBootstrapResolver returns a resolver that queries the servers (host:port) in order.
+func newBootstrapResolver(servers []string) *bootstrapResolver {
+	return &bootstrapResolver{
+		servers:  servers,
+		exchange: exchangeBootstrap,
+		hosts:    make(map[string]*bootstrapEntry),
+	}
+}
+
+// exchangeBootstrap sends the query over UDP and retries over TCP if the response is truncated.
+func exchangeBootstrap(ctx context.Context, m *dns.Msg, server string) (*dns.Msg, error) {
+	client := &dns.Client{Timeout: bootstrapTimeout}
+	r, _, err := client.ExchangeContext(ctx, m, server)
+	if err == nil && r.Truncated {
+		client.Net = "tcp"
+		r, _, err = client.ExchangeContext(ctx, m, server)
+	}
+	return r, err
+}
+
+// LookupIP returns the addresses of the host. The host is resolved if it isn't cached yet.
+func (r *bootstrapResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	r.mu.RLock()
+	entry, ok := r.hosts[host]
+	r.mu.RUnlock()
+	if ok {
+		return entry.ips, nil
+	}
+	return r.resolve(ctx, host)
+}
+
+// DialContext connects to the address, the host of which is resolved with the bootstrap servers.
+// Addresses are tried in order until a connection is established.
+func (r *bootstrapResolver) DialContext(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := r.LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	for _, ip := range ips {
+		if conn, err = d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+			return
+		}
+	}
+	return
+}
+
+// DialQUIC is the QUIC counterpart of DialContext used by the HTTP/3 transport.
+func (r *bootstrapResolver) DialQUIC(ctx context.Context, addr string,
+	tlsCfg *tls.Config, cfg *quic.Config) (conn quic.EarlyConnection, err error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := r.LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if conn, err = quic.DialAddrEarly(ctx, net.JoinHostPort(ip.String(), port), tlsCfg, cfg); err == nil {
+			return
+		}
+	}
+	return
+}
+
+// Start starts the goroutine that resolves the cached hosts again before their addresses expire.
+func (r *bootstrapResolver) Start() {
+	r.stop = make(chan struct{})
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(bootstrapRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				r.refresh()
+			}
+		}
+	}()
+}
+
+// Stop stops the refreshing goroutine and waits for it to exit.
+func (r *bootstrapResolver) Stop() {
+	if r.stop == nil {
+		return
+	}
+	close(r.stop)
+	r.wg.Wait()
+}
+
+// refresh resolves the hosts with addresses expiring before the next refresh.
+func (r *bootstrapResolver) refresh() {
+	deadline := time.Now().Add(bootstrapRefreshInterval)
+	var hosts []string
+	r.mu.RLock()
+	for host, entry := range r.hosts {
+		if entry.expires.Before(deadline) {
+			hosts = append(hosts, host)
+		}
+	}
+	r.mu.RUnlock()
+	for _, host := range hosts {
+		select {
+		case <-r.stop:
+			return
+		default:
+		}
+		if _, err := r.resolve(context.Background(), host); err != nil {
+			log.Warningf("Failed to resolve upstream host %s with bootstrap servers: %s", host, err)
+		}
+	}
+}
+
+// resolve queries the A and AAAA records of the host and caches the addresses
+// for the smallest TTL of the records.
+func (r *bootstrapResolver) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	var ips []net.IP
+	var ttl uint32
+	var err error
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		qips, qttl, qerr := r.query(ctx, host, qtype)
+		if qerr != nil {
+			err = qerr
+			continue
+		}
+		if len(qips) > 0 && (len(ips) == 0 || qttl < ttl) {
+			ttl = qttl
+		}
+		ips = append(ips, qips...)
+	}
+	if len(ips) == 0 {
+		if err == nil {
+			err = errBootstrapNoAddrs
+		}
+		return nil, fmt.Errorf("bootstrap lookup %s: %w", host, err)
+	}
+
+	expiry := time.Duration(ttl) * time.Second
+	if expiry < bootstrapMinTTL {
+		expiry = bootstrapMinTTL
+	}
+	r.mu.Lock()
+	r.hosts[host] = &bootstrapEntry{ips: ips, expires: time.Now().Add(expiry)}
+	r.mu.Unlock()
+	return ips, nil
+}
+
+// query returns the addresses of the host of the given type and their smallest TTL,
+// the servers are tried in order until one of them answers.
+func (r *bootstrapResolver) query(ctx context.Context, host string, qtype uint16) (ips []net.IP, ttl uint32, err error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(host), qtype)
+	for _, server := range r.servers {
+		var resp *dns.Msg
+		if resp, err = r.exchange(ctx, m, server); err != nil {
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+			err = fmt.Errorf("%s answered %s", server, dns.RcodeToString[resp.Rcode])
+			continue
+		}
+		for _, rr := range resp.Answer {
+			var ip net.IP
+			switch rr := rr.(type) {
+			case *dns.A:
+				ip = rr.A
+			case *dns.AAAA:
+				ip = rr.AAAA
+			default:
+				continue
+			}
+			if len(ips) == 0 || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+			ips = append(ips, ip)
+		}
+		return ips, ttl, nil
+	}
+	return
+}
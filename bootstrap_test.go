@@ -0,0 +1,199 @@
+package https
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func newBootstrapServer(t *testing.T, ttl uint32, queryCount *int32) *dnstest.Server {
+	s := dnstest.NewServer(func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(queryCount, 1)
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		hdr := dns.RR_Header{Name: req.Question[0].Name, Class: dns.ClassINET, Ttl: ttl}
+		switch req.Question[0].Qtype {
+		case dns.TypeA:
+			hdr.Rrtype = dns.TypeA
+			resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: net.IPv4(127, 0, 0, 1)})
+		case dns.TypeAAAA:
+			hdr.Rrtype = dns.TypeAAAA
+			resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.IPv6loopback})
+		}
+		require.NoError(t, w.WriteMsg(resp))
+	})
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestBootstrapResolverLookupIP(t *testing.T) {
+	var queryCount int32
+	s := newBootstrapServer(t, 300, &queryCount)
+	r := newBootstrapResolver([]string{s.Addr})
+
+	ips, err := r.LookupIP(context.Background(), "dns.example")
+	require.NoError(t, err)
+	require.Equal(t, []net.IP{net.IPv4(127, 0, 0, 1).To4(), net.IPv6loopback}, ips)
+	require.Equal(t, int32(2), atomic.LoadInt32(&queryCount))
+
+	// cached
+	_, err = r.LookupIP(context.Background(), "dns.example")
+	require.NoError(t, err)
+	require.Equal(t, int32(2), atomic.LoadInt32(&queryCount))
+	require.WithinDuration(t, time.Now().Add(300*time.Second), r.hosts["dns.example"].expires, time.Second)
+
+	// addresses are not resolved
+	ips, err = r.LookupIP(context.Background(), "10.0.0.1")
+	require.NoError(t, err)
+	require.Equal(t, []net.IP{net.ParseIP("10.0.0.1")}, ips)
+	require.Equal(t, int32(2), atomic.LoadInt32(&queryCount))
+}
+
+func TestBootstrapResolverMinTTL(t *testing.T) {
+	var queryCount int32
+	s := newBootstrapServer(t, 1, &queryCount)
+	r := newBootstrapResolver([]string{s.Addr})
+
+	_, err := r.LookupIP(context.Background(), "dns.example")
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now().Add(bootstrapMinTTL), r.hosts["dns.example"].expires, time.Second)
+}
+
+func TestBootstrapResolverServerFailover(t *testing.T) {
+	r := newBootstrapResolver([]string{"server1", "server2"})
+	var servers []string
+	r.exchange = func(_ context.Context, m *dns.Msg, server string) (*dns.Msg, error) {
+		servers = append(servers, server)
+		if server == "server1" {
+			return nil, errors.New("exchange error")
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(m)
+		if m.Question[0].Qtype == dns.TypeA {
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(10, 0, 0, 1),
+			})
+		}
+		return resp, nil
+	}
+
+	ips, err := r.LookupIP(context.Background(), "dns.example")
+	require.NoError(t, err)
+	require.Equal(t, []net.IP{net.IPv4(10, 0, 0, 1)}, ips)
+	require.Equal(t, []string{"server1", "server2", "server1", "server2"}, servers)
+}
+
+func TestBootstrapResolverError(t *testing.T) {
+	tests := []struct {
+		name     string
+		exchange func(ctx context.Context, m *dns.Msg, server string) (*dns.Msg, error)
+	}{
+		{
+			name: "ExchangeError",
+			exchange: func(_ context.Context, _ *dns.Msg, _ string) (*dns.Msg, error) {
+				return nil, errors.New("exchange error")
+			},
+		},
+		{
+			name: "ServFail",
+			exchange: func(_ context.Context, m *dns.Msg, _ string) (*dns.Msg, error) {
+				resp := new(dns.Msg)
+				resp.SetRcode(m, dns.RcodeServerFailure)
+				return resp, nil
+			},
+		},
+		{
+			name: "NoAddresses",
+			exchange: func(_ context.Context, m *dns.Msg, _ string) (*dns.Msg, error) {
+				resp := new(dns.Msg)
+				resp.SetRcode(m, dns.RcodeNameError)
+				return resp, nil
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newBootstrapResolver([]string{"server1"})
+			r.exchange = tt.exchange
+
+			_, err := r.LookupIP(context.Background(), "dns.example")
+			require.Error(t, err)
+			require.Empty(t, r.hosts)
+		})
+	}
+}
+
+func TestBootstrapResolverRefresh(t *testing.T) {
+	var queryCount int32
+	s := newBootstrapServer(t, 300, &queryCount)
+	r := newBootstrapResolver([]string{s.Addr})
+	r.hosts["fresh.example"] = &bootstrapEntry{ips: []net.IP{net.IPv4(10, 0, 0, 1)}, expires: time.Now().Add(time.Hour)}
+	r.hosts["expiring.example"] = &bootstrapEntry{ips: []net.IP{net.IPv4(10, 0, 0, 2)}, expires: time.Now().Add(time.Second)}
+	r.stop = make(chan struct{})
+
+	r.refresh()
+	require.Equal(t, int32(2), atomic.LoadInt32(&queryCount))
+	require.Equal(t, []net.IP{net.IPv4(10, 0, 0, 1)}, r.hosts["fresh.example"].ips)
+	require.Equal(t, []net.IP{net.IPv4(127, 0, 0, 1).To4(), net.IPv6loopback}, r.hosts["expiring.example"].ips)
+}
+
+func TestBootstrapResolverRefreshErrorKeepsAddresses(t *testing.T) {
+	r := newBootstrapResolver([]string{"server1"})
+	r.exchange = func(_ context.Context, _ *dns.Msg, _ string) (*dns.Msg, error) {
+		return nil, errors.New("exchange error")
+	}
+	ips := []net.IP{net.IPv4(10, 0, 0, 1)}
+	r.hosts["dns.example"] = &bootstrapEntry{ips: ips, expires: time.Now().Add(-time.Second)}
+	r.stop = make(chan struct{})
+
+	r.refresh()
+	result, err := r.LookupIP(context.Background(), "dns.example")
+	require.NoError(t, err)
+	require.Equal(t, ips, result)
+}
+
+func TestBootstrapResolverStartStop(t *testing.T) {
+	r := newBootstrapResolver(nil)
+	r.Stop()
+	r.Start()
+	r.Stop()
+}
+
+func TestBootstrapHTTPTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	srvURL, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	_, port, err := net.SplitHostPort(srvURL.Host)
+	require.NoError(t, err)
+
+	var queryCount int32
+	s := newBootstrapServer(t, 300, &queryCount)
+	tr := newHTTPTransport(transportH2, nil, newBootstrapResolver([]string{s.Addr}))
+	defer closeTransport(tr)
+
+	client := &http.Client{Transport: tr}
+	resp, err := client.Get("http://upstream.test:" + port)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.Equal(t, int32(2), atomic.LoadInt32(&queryCount))
+}
+
+func TestBootstrapH3Transport(t *testing.T) {
+	require.Nil(t, newH3Transport(nil, nil).Dial)
+	require.NotNil(t, newH3Transport(nil, newBootstrapResolver([]string{"9.9.9.9:53"})).Dial)
+}
@@ -0,0 +1,104 @@
+package https
+
+import (
+	"sync"
+	"time"
+)
+
+const defaultFailTimeout = 10 * time.Second
+
+// circuit breaker states, the values are exported via BreakerState metric.
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker is a passive per-upstream circuit breaker.
+// The circuit opens after maxFails consecutive failed requests and the upstream is considered down.
+// After failTimeout the circuit becomes half-open and a single trial request is allowed, the upstream
+// is still down for the rest requests: the successful trial request closes the circuit, the failed one
+// opens it again. The trial request that has no result within failTimeout, e.g. the cancelled one,
+// is replaced with a new one.
+type circuitBreaker struct {
+	addr        string
+	maxFails    int
+	failTimeout time.Duration
+
+	mu       sync.Mutex
+	state    int
+	fails    int
+	openedAt time.Time
+	// probing is true if the trial request in the half-open state started at probedAt is in flight
+	probing  bool
+	probedAt time.Time
+}
+
+// newCircuitBreaker creates a new circuit breaker for the upstream addr,
+// failTimeout defaults to 10 seconds if it is not positive.
+func newCircuitBreaker(addr string, maxFails int, failTimeout time.Duration) *circuitBreaker {
+	if failTimeout <= 0 {
+		failTimeout = defaultFailTimeout
+	}
+	b := &circuitBreaker{addr: addr, maxFails: maxFails, failTimeout: failTimeout}
+	BreakerState.WithLabelValues(addr).Set(breakerClosed)
+	return b
+}
+
+// Down implements upstreamHealth.
+func (b *circuitBreaker) Down() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	switch b.state {
+	case breakerClosed:
+		return false
+	case breakerOpen:
+		if now.Sub(b.openedAt) < b.failTimeout {
+			return true
+		}
+		b.setState(breakerHalfOpen)
+	default:
+		if b.probing && now.Sub(b.probedAt) < b.failTimeout {
+			return true
+		}
+	}
+	// the caller sends the trial request
+	b.probing = true
+	b.probedAt = now
+	return false
+}
+
+// Success records a successful request to the upstream.
+func (b *circuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fails = 0
+	b.probing = false
+	if b.state != breakerClosed {
+		b.setState(breakerClosed)
+	}
+}
+
+// Failure records a failed request to the upstream.
+func (b *circuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fails++
+	b.probing = false
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.fails >= b.maxFails) {
+		b.openedAt = time.Now()
+		b.setState(breakerOpen)
+	}
+}
+
+func (b *circuitBreaker) setState(state int) {
+	b.state = state
+	BreakerState.WithLabelValues(b.addr).Set(float64(state))
+	switch state {
+	case breakerOpen:
+		log.Warningf("Upstream %s is ejected after %d consecutive failures", b.addr, b.fails)
+	case breakerClosed:
+		log.Infof("Upstream %s is restored", b.addr)
+	}
+}
@@ -0,0 +1,74 @@
+package https
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker(upstreamURL, 2, 50*time.Millisecond)
+	require.False(t, b.Down())
+	require.Equal(t, float64(breakerClosed), testutil.ToFloat64(BreakerState.WithLabelValues(upstreamURL)))
+
+	b.Failure()
+	require.False(t, b.Down(), "circuit must be closed before max fails")
+	b.Success()
+	b.Failure()
+	require.False(t, b.Down(), "success must reset consecutive failures")
+
+	b.Failure()
+	require.True(t, b.Down(), "circuit must be open after max fails")
+	require.Equal(t, float64(breakerOpen), testutil.ToFloat64(BreakerState.WithLabelValues(upstreamURL)))
+
+	time.Sleep(60 * time.Millisecond)
+	require.False(t, b.Down(), "circuit must be half-open after fail timeout")
+	require.Equal(t, float64(breakerHalfOpen), testutil.ToFloat64(BreakerState.WithLabelValues(upstreamURL)))
+	require.True(t, b.Down(), "only one trial request must be allowed in half-open state")
+
+	b.Failure()
+	require.True(t, b.Down(), "circuit must be open after failure in half-open state")
+
+	time.Sleep(60 * time.Millisecond)
+	require.False(t, b.Down())
+	b.Success()
+	require.False(t, b.Down())
+	require.Equal(t, float64(breakerClosed), testutil.ToFloat64(BreakerState.WithLabelValues(upstreamURL)))
+}
+
+func TestCircuitBreakerHalfOpenSingleTrial(t *testing.T) {
+	b := newCircuitBreaker(upstreamURL, 1, 50*time.Millisecond)
+	b.Failure()
+	time.Sleep(60 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	var admitted int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !b.Down() {
+				atomic.AddInt32(&admitted, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(1), atomic.LoadInt32(&admitted), "only one concurrent request must be admitted")
+
+	// the trial request without result is replaced after fail timeout
+	time.Sleep(60 * time.Millisecond)
+	require.False(t, b.Down())
+	require.True(t, b.Down())
+	b.Success()
+	require.False(t, b.Down())
+	require.False(t, b.Down())
+}
+
+func TestCircuitBreakerDefaultFailTimeout(t *testing.T) {
+	b := newCircuitBreaker(upstreamURL, 1, 0)
+	require.Equal(t, defaultFailTimeout, b.failTimeout)
+}
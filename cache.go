@@ -0,0 +1,296 @@
+package https
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/coredns/plugin/cache/freq"
+	"github.com/coredns/coredns/plugin/pkg/cache"
+	"github.com/coredns/coredns/plugin/pkg/dnsutil"
+	"github.com/coredns/coredns/plugin/pkg/response"
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultCacheSize   = 10000
+	defaultCacheMaxTTL = time.Hour
+
+	defaultPrefetchDuration   = time.Minute
+	defaultPrefetchPercentage = 10
+
+	// RFC8767 Section 4:
+	// When a DNS server uses a stale record in a response, the TTL MUST be set
+	// to a value greater than 0. The value of 30 seconds is RECOMMENDED.
+	staleTTL = 30
+	// staleRecheckInterval is the time after a failed upstream query during which
+	// stale responses are served immediately without waiting for the upstream
+	// (the failure recheck timer of RFC 8767 Section 5).
+	staleRecheckInterval = 30 * time.Second
+)
+
+// cacheDNSClient is a DNS client that caches successful and negative responses of the underlying client.
+// Responses are cached for their minimal TTL clamped to [minTTL, maxTTL].
+// If serveStale is set, expired responses are kept for that long and returned
+// when the underlying client fails (RFC 8767).
+// If prefetch is set, entries queried at least prefetch times within prefetchDuration
+// are refreshed in the background when their remaining TTL drops below prefetchPercentage.
+type cacheDNSClient struct {
+	client             dnsClient
+	cache              *cache.Cache
+	minTTL             time.Duration
+	maxTTL             time.Duration
+	serveStale         time.Duration
+	prefetch           int
+	prefetchDuration   time.Duration
+	prefetchPercentage int
+	subnets            upstreamSubnets
+	now                func() time.Time
+
+	mu sync.Mutex
+	// refreshing are the keys of entries being refreshed in the background
+	refreshing map[uint64]struct{}
+}
+
+// cacheEntry is a cached DNS response.
+type cacheEntry struct {
+	msg     *dns.Msg
+	expires time.Time
+	// ttl is the original cache TTL of the entry
+	ttl time.Duration
+	// freq is the number of recent hits of the entry
+	freq *freq.Freq
+	// failed is the time in unix nanoseconds of the last failed upstream query of the stale entry
+	failed int64
+}
+
+func newCacheDNSClient(client dnsClient, size int, opts ...cacheDNSClientOption) *cacheDNSClient {
+	c := &cacheDNSClient{
+		client:     client,
+		cache:      cache.New(size),
+		maxTTL:     defaultCacheMaxTTL,
+		now:        time.Now,
+		refreshing: make(map[uint64]struct{}),
+	}
+	// option pattern
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+type cacheDNSClientOption func(c *cacheDNSClient)
+
+func withCacheMinTTL(minTTL time.Duration) cacheDNSClientOption {
+	return func(c *cacheDNSClient) {
+		c.minTTL = minTTL
+	}
+}
+
+func withCacheMaxTTL(maxTTL time.Duration) cacheDNSClientOption {
+	return func(c *cacheDNSClient) {
+		c.maxTTL = maxTTL
+	}
+}
+
+func withCacheServeStale(serveStale time.Duration) cacheDNSClientOption {
+	return func(c *cacheDNSClient) {
+		c.serveStale = serveStale
+	}
+}
+
+// withCacheUpstreamSubnets sets the add policies of the upstreams, so that responses are cached
+// per client subnet that the upstreams get.
+func withCacheUpstreamSubnets(subnets upstreamSubnets) cacheDNSClientOption {
+	return func(c *cacheDNSClient) {
+		c.subnets = subnets
+	}
+}
+
+func withCachePrefetch(amount int, duration time.Duration, percentage int) cacheDNSClientOption {
+	return func(c *cacheDNSClient) {
+		c.prefetch = amount
+		c.prefetchDuration = duration
+		c.prefetchPercentage = percentage
+	}
+}
+
+func (c *cacheDNSClient) Query(ctx context.Context, dnsreq []byte) (r *dns.Msg, err error) {
+	req, err := unpackRequest(ctx, dnsreq)
+	if err != nil {
+		return c.client.Query(ctx, dnsreq)
+	}
+
+	key := cacheKey(req, c.subnets.subnets(ctx, req))
+	now := c.now()
+	entry, ok := c.get(key)
+	if ok && now.Before(entry.expires) {
+		CacheHitCount.Add(1)
+		if c.shouldPrefetch(entry, now) && c.refresh(ctx, key, dnsreq) {
+			CachePrefetchCount.Add(1)
+		}
+		return entry.reply(req, uint32(entry.expires.Sub(now).Seconds())), nil
+	}
+	CacheMissCount.Add(1)
+
+	stale := ok && now.Before(entry.expires.Add(c.serveStale))
+	if stale && entry.recentlyFailed(now) {
+		// the upstream has just failed, don't make the client wait for it again
+		c.refresh(ctx, key, dnsreq)
+		return c.replyStale(entry, req), nil
+	}
+
+	// decorator pattern
+	r, err = c.client.Query(ctx, dnsreq)
+	if stale && (err != nil || r.Rcode == dns.RcodeServerFailure) {
+		// the following queries are answered with the stale response and refresh it in the background
+		entry.setFailed(now)
+		return c.replyStale(entry, req), nil
+	}
+	if err != nil {
+		return
+	}
+	c.set(key, r, now)
+	return
+}
+
+func (c *cacheDNSClient) replyStale(entry *cacheEntry, req *dns.Msg) *dns.Msg {
+	CacheStaleCount.Add(1)
+	return entry.reply(req, staleTTL)
+}
+
+// shouldPrefetch updates hits of the entry and reports whether the entry is popular
+// and close enough to expiry to be refreshed in advance.
+func (c *cacheDNSClient) shouldPrefetch(entry *cacheEntry, now time.Time) bool {
+	if c.prefetch == 0 {
+		return false
+	}
+	hits := entry.freq.Update(c.prefetchDuration, now)
+	threshold := entry.ttl * time.Duration(c.prefetchPercentage) / 100
+	return hits >= c.prefetch && entry.expires.Sub(now) <= threshold
+}
+
+// refresh queries the underlying client in the background on behalf of the client of ctx
+// and updates the cache entry on success.
+// Only one refresh per key runs at a time, refresh returns false if it is already running.
+func (c *cacheDNSClient) refresh(ctx context.Context, key uint64, dnsreq []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.refreshing[key]; ok {
+		return false
+	}
+	c.refreshing[key] = struct{}{}
+
+	// dnsreq may be reused by the caller after Query returns
+	req := make([]byte, len(dnsreq))
+	copy(req, dnsreq)
+	// the client subnet of the refreshed entry is kept, but not the deadline of the client query
+	refreshCtx := withClient(context.Background(), ctx)
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.refreshing, key)
+			c.mu.Unlock()
+		}()
+		r, err := c.client.Query(refreshCtx, req)
+		if err != nil || r.Rcode == dns.RcodeServerFailure {
+			if entry, ok := c.get(key); ok {
+				entry.setFailed(c.now())
+			}
+			return
+		}
+		c.set(key, r, c.now())
+	}()
+	return true
+}
+
+func (c *cacheDNSClient) get(key uint64) (*cacheEntry, bool) {
+	if el, ok := c.cache.Get(key); ok {
+		return el.(*cacheEntry), true
+	}
+	return nil, false
+}
+
+func (c *cacheDNSClient) set(key uint64, r *dns.Msg, now time.Time) {
+	if r.Truncated {
+		return
+	}
+	mt, _ := response.Typify(r, now)
+	if mt != response.NoError && mt != response.NameError && mt != response.NoData {
+		return
+	}
+	ttl := dnsutil.MinimalTTL(r, mt)
+	if ttl < c.minTTL {
+		ttl = c.minTTL
+	}
+	if ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	entry := &cacheEntry{msg: r.Copy(), expires: now.Add(ttl), ttl: ttl}
+	if old, ok := c.get(key); ok {
+		// keep the popularity of the refreshed entry
+		entry.freq = old.freq
+	} else {
+		entry.freq = freq.New(now)
+	}
+	c.cache.Add(key, entry)
+}
+
+func (e *cacheEntry) recentlyFailed(now time.Time) bool {
+	failed := atomic.LoadInt64(&e.failed)
+	return failed != 0 && now.Sub(time.Unix(0, failed)) < staleRecheckInterval
+}
+
+func (e *cacheEntry) setFailed(now time.Time) {
+	atomic.StoreInt64(&e.failed, now.UnixNano())
+}
+
+// reply returns a copy of the cached response for the given request with the given TTL of all records.
+func (e *cacheEntry) reply(req *dns.Msg, ttl uint32) *dns.Msg {
+	r := e.msg.Copy()
+	r.Id = req.Id
+	// keep the case of the query name of the request
+	r.Question = req.Question
+	setTTL := func(rrs []dns.RR) {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				// OPT records use TTL field for extended rcode and flags
+				continue
+			}
+			rr.Header().Ttl = ttl
+		}
+	}
+	setTTL(r.Answer)
+	setTTL(r.Ns)
+	setTTL(r.Extra)
+	return r
+}
+
+// cacheKey returns the hash of the query name, type, class, the CD flag, the DNSSEC OK bit,
+// the Client Subnet option of the request and the Client Subnet options the upstreams send, see upstreamSubnets.
+func cacheKey(req *dns.Msg, subnets []*dns.EDNS0_SUBNET) uint64 {
+	q := req.Question[0]
+	h := fnv.New64a()
+	h.Write([]byte(strings.ToLower(q.Name)))
+	var buf [5]byte
+	binary.BigEndian.PutUint16(buf[0:], q.Qtype)
+	binary.BigEndian.PutUint16(buf[2:], q.Qclass)
+	// responses to CD queries may not be validated by the upstream
+	if req.CheckingDisabled {
+		buf[4] |= 1
+	}
+	if opt := req.IsEdns0(); opt != nil && opt.Do() {
+		buf[4] |= 1 << 1
+	}
+	h.Write(buf[:])
+	hashSubnet(h, req)
+	hashSubnets(h, subnets)
+	return h.Sum64()
+}
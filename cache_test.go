@@ -0,0 +1,508 @@
+package https
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+type mockClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *mockClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *mockClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newMockClock() *mockClock {
+	return &mockClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func newCountingDNSClient(callCount *int, newMsg func() *dns.Msg) dnsClient {
+	return mockDNSClientFunc(func(_ context.Context, dnsreq []byte) (*dns.Msg, error) {
+		*callCount++
+		req := new(dns.Msg)
+		if err := req.Unpack(dnsreq); err != nil {
+			return nil, err
+		}
+		msg := newMsg()
+		msg.Id = req.Id
+		return msg, nil
+	})
+}
+
+func newAnswerDNSMsg(ttl uint32) *dns.Msg {
+	msg := newExpectedDNSMsg()
+	msg.Answer[0].Header().Ttl = ttl
+	return msg
+}
+
+func newCacheRequest(t *testing.T, id uint16, name string, qtype uint16) []byte {
+	t.Helper()
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+	msg.Id = id
+	return packMsg(t, msg)
+}
+
+func TestCacheDNSClientHit(t *testing.T) {
+	clock := newMockClock()
+	callCount := 0
+	client := newCacheDNSClient(newCountingDNSClient(&callCount, func() *dns.Msg {
+		return newAnswerDNSMsg(30)
+	}), 10)
+	client.now = clock.Now
+
+	hits := testutil.ToFloat64(CacheHitCount)
+	misses := testutil.ToFloat64(CacheMissCount)
+
+	result, err := client.Query(context.Background(), newCacheRequest(t, 1, "example.com.", dns.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, uint16(1), result.Id)
+	require.Equal(t, uint32(30), result.Answer[0].Header().Ttl)
+
+	clock.Add(10 * time.Second)
+	result, err = client.Query(context.Background(), newCacheRequest(t, 2, "EXAMPLE.com.", dns.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, 1, callCount, "response must be served from the cache")
+	require.Equal(t, uint16(2), result.Id)
+	require.Equal(t, "EXAMPLE.com.", result.Question[0].Name, "query name case of the request must be kept")
+	require.Equal(t, uint32(20), result.Answer[0].Header().Ttl)
+
+	require.Equal(t, hits+1, testutil.ToFloat64(CacheHitCount))
+	require.Equal(t, misses+1, testutil.ToFloat64(CacheMissCount))
+}
+
+func TestCacheDNSClientCachedResponseIsCopied(t *testing.T) {
+	callCount := 0
+	client := newCacheDNSClient(newCountingDNSClient(&callCount, func() *dns.Msg {
+		return newAnswerDNSMsg(30)
+	}), 10)
+
+	result, err := client.Query(context.Background(), newCacheRequest(t, 1, "example.com.", dns.TypeA))
+	require.NoError(t, err)
+	result.Answer = nil
+
+	result, err = client.Query(context.Background(), newCacheRequest(t, 1, "example.com.", dns.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, 1, callCount)
+	require.Len(t, result.Answer, 1)
+}
+
+func TestCacheDNSClientExpired(t *testing.T) {
+	clock := newMockClock()
+	callCount := 0
+	client := newCacheDNSClient(newCountingDNSClient(&callCount, func() *dns.Msg {
+		return newAnswerDNSMsg(30)
+	}), 10)
+	client.now = clock.Now
+
+	_, err := client.Query(context.Background(), newCacheRequest(t, 1, "example.com.", dns.TypeA))
+	require.NoError(t, err)
+	clock.Add(30 * time.Second)
+	_, err = client.Query(context.Background(), newCacheRequest(t, 1, "example.com.", dns.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, 2, callCount, "expired response must not be served from the cache")
+}
+
+func TestCacheDNSClientKey(t *testing.T) {
+	callCount := 0
+	client := newCacheDNSClient(newCountingDNSClient(&callCount, func() *dns.Msg {
+		return newAnswerDNSMsg(30)
+	}), 10)
+
+	doReq := new(dns.Msg)
+	doReq.SetQuestion("example.com.", dns.TypeA)
+	doReq.SetEdns0(dns.DefaultMsgSize, true)
+
+	chaosReq := new(dns.Msg)
+	chaosReq.SetQuestion("example.com.", dns.TypeA)
+	chaosReq.Question[0].Qclass = dns.ClassCHAOS
+
+	cdReq := new(dns.Msg)
+	cdReq.SetQuestion("example.com.", dns.TypeA)
+	cdReq.CheckingDisabled = true
+
+	requests := [][]byte{
+		newCacheRequest(t, 1, "example.com.", dns.TypeA),
+		newCacheRequest(t, 1, "example.org.", dns.TypeA),
+		newCacheRequest(t, 1, "example.com.", dns.TypeAAAA),
+		packMsg(t, doReq),
+		packMsg(t, chaosReq),
+		packMsg(t, cdReq),
+	}
+	for _, req := range requests {
+		_, err := client.Query(context.Background(), req)
+		require.NoError(t, err)
+	}
+	require.Equal(t, len(requests), callCount, "each request must have its own cache entry")
+}
+
+func TestCacheDNSClientNotCached(t *testing.T) {
+	tests := []struct {
+		name   string
+		newMsg func() *dns.Msg
+	}{
+		{
+			name: "ServerFailure",
+			newMsg: func() *dns.Msg {
+				msg := newAnswerDNSMsg(30)
+				msg.Rcode = dns.RcodeServerFailure
+				return msg
+			},
+		},
+		{
+			name: "Refused",
+			newMsg: func() *dns.Msg {
+				msg := newAnswerDNSMsg(30)
+				msg.Rcode = dns.RcodeRefused
+				return msg
+			},
+		},
+		{
+			name: "Truncated",
+			newMsg: func() *dns.Msg {
+				msg := newAnswerDNSMsg(30)
+				msg.Truncated = true
+				return msg
+			},
+		},
+		{
+			name: "ZeroTTL",
+			newMsg: func() *dns.Msg {
+				return newAnswerDNSMsg(0)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			callCount := 0
+			client := newCacheDNSClient(newCountingDNSClient(&callCount, tt.newMsg), 10)
+			for i := 0; i < 2; i++ {
+				_, err := client.Query(context.Background(), newCacheRequest(t, 1, "example.com.", dns.TypeA))
+				require.NoError(t, err)
+			}
+			require.Equal(t, 2, callCount)
+		})
+	}
+}
+
+func TestCacheDNSClientNegativeResponse(t *testing.T) {
+	clock := newMockClock()
+	callCount := 0
+	client := newCacheDNSClient(newCountingDNSClient(&callCount, func() *dns.Msg {
+		msg := newExpectedDNSMsg()
+		msg.Rcode = dns.RcodeNameError
+		msg.Answer = nil
+		msg.Ns = []dns.RR{&dns.SOA{
+			Hdr:    dns.RR_Header{Name: "com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+			Ns:     "ns.com.",
+			Mbox:   "admin.com.",
+			Minttl: 60,
+		}}
+		return msg
+	}), 10)
+	client.now = clock.Now
+
+	_, err := client.Query(context.Background(), newCacheRequest(t, 1, "example.com.", dns.TypeA))
+	require.NoError(t, err)
+	clock.Add(59 * time.Second)
+	result, err := client.Query(context.Background(), newCacheRequest(t, 1, "example.com.", dns.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, 1, callCount)
+	require.Equal(t, dns.RcodeNameError, result.Rcode)
+	require.Equal(t, uint32(1), result.Ns[0].Header().Ttl)
+}
+
+func TestCacheDNSClientTTLClamp(t *testing.T) {
+	tests := []struct {
+		name        string
+		ttl         uint32
+		opts        []cacheDNSClientOption
+		elapsed     time.Duration
+		expectedHit bool
+		expectedTTL uint32
+	}{
+		{
+			name:        "MinTTL",
+			ttl:         5,
+			opts:        []cacheDNSClientOption{withCacheMinTTL(time.Minute)},
+			elapsed:     30 * time.Second,
+			expectedHit: true,
+			expectedTTL: 30,
+		},
+		{
+			name:        "MinTTLZeroTTL",
+			ttl:         0,
+			opts:        []cacheDNSClientOption{withCacheMinTTL(time.Minute)},
+			elapsed:     30 * time.Second,
+			expectedHit: true,
+			expectedTTL: 30,
+		},
+		{
+			name:        "MaxTTL",
+			ttl:         300,
+			opts:        []cacheDNSClientOption{withCacheMaxTTL(time.Minute)},
+			elapsed:     time.Minute,
+			expectedHit: false,
+		},
+		{
+			name:        "MaxTTLCapsRecordTTL",
+			ttl:         300,
+			opts:        []cacheDNSClientOption{withCacheMaxTTL(time.Minute)},
+			elapsed:     10 * time.Second,
+			expectedHit: true,
+			expectedTTL: 50,
+		},
+		{
+			name:        "DefaultMaxTTL",
+			ttl:         2 * 3600,
+			elapsed:     time.Hour,
+			expectedHit: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newMockClock()
+			callCount := 0
+			client := newCacheDNSClient(newCountingDNSClient(&callCount, func() *dns.Msg {
+				return newAnswerDNSMsg(tt.ttl)
+			}), 10, tt.opts...)
+			client.now = clock.Now
+
+			_, err := client.Query(context.Background(), newCacheRequest(t, 1, "example.com.", dns.TypeA))
+			require.NoError(t, err)
+			clock.Add(tt.elapsed)
+			result, err := client.Query(context.Background(), newCacheRequest(t, 1, "example.com.", dns.TypeA))
+			require.NoError(t, err)
+			if !tt.expectedHit {
+				require.Equal(t, 2, callCount)
+				return
+			}
+			require.Equal(t, 1, callCount)
+			require.Equal(t, tt.expectedTTL, result.Answer[0].Header().Ttl)
+		})
+	}
+}
+
+func TestCacheDNSClientError(t *testing.T) {
+	callCount := 0
+	client := newCacheDNSClient(mockDNSClientFunc(func(_ context.Context, _ []byte) (*dns.Msg, error) {
+		callCount++
+		return nil, errors.New("upstream error")
+	}), 10)
+	for i := 0; i < 2; i++ {
+		_, err := client.Query(context.Background(), newCacheRequest(t, 1, "example.com.", dns.TypeA))
+		require.Error(t, err)
+	}
+	require.Equal(t, 2, callCount)
+}
+
+func TestCacheDNSClientMalformedRequest(t *testing.T) {
+	client1 := &mockDNSClient{reqBody: []byte("abc"), t: t}
+	client := newCacheDNSClient(client1, 10)
+	for i := 0; i < 2; i++ {
+		result, err := client.Query(context.Background(), []byte("abc"))
+		require.NoError(t, err)
+		require.Equal(t, net.IPv4(1, 1, 1, 1).String(), result.Answer[0].(*dns.A).A.String())
+	}
+	require.Equal(t, 2, client1.callCount, "malformed requests must not be cached")
+}
+
+func TestCacheDNSClientServeStale(t *testing.T) {
+	clock := newMockClock()
+	var callCount int32
+	var upstreamErr atomic.Value
+	upstreamErr.Store(false)
+	client := newCacheDNSClient(mockDNSClientFunc(func(_ context.Context, dnsreq []byte) (*dns.Msg, error) {
+		atomic.AddInt32(&callCount, 1)
+		if upstreamErr.Load().(bool) {
+			return nil, errors.New("upstream error")
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(dnsreq); err != nil {
+			return nil, err
+		}
+		msg := newAnswerDNSMsg(30)
+		msg.Id = req.Id
+		return msg, nil
+	}), 10, withCacheServeStale(time.Hour))
+	client.now = clock.Now
+
+	_, err := client.Query(context.Background(), newCacheRequest(t, 1, "example.com.", dns.TypeA))
+	require.NoError(t, err)
+
+	// the upstream fails, the stale response is returned
+	upstreamErr.Store(true)
+	clock.Add(time.Minute)
+	stale := testutil.ToFloat64(CacheStaleCount)
+	result, err := client.Query(context.Background(), newCacheRequest(t, 2, "example.com.", dns.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, int32(2), atomic.LoadInt32(&callCount))
+	require.Equal(t, uint16(2), result.Id)
+	require.Equal(t, uint32(staleTTL), result.Answer[0].Header().Ttl)
+	require.Equal(t, stale+1, testutil.ToFloat64(CacheStaleCount))
+
+	// the upstream is recovered, the stale response is returned immediately and refreshed in the background
+	upstreamErr.Store(false)
+	clock.Add(time.Second)
+	result, err = client.Query(context.Background(), newCacheRequest(t, 3, "example.com.", dns.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, uint32(staleTTL), result.Answer[0].Header().Ttl)
+	require.Eventually(t, func() bool {
+		entry, ok := client.get(cacheKey(newRequestDNSMsg(), nil))
+		return ok && clock.Now().Before(entry.expires)
+	}, time.Second, 10*time.Millisecond, "stale response must be refreshed in the background")
+	require.Equal(t, int32(3), atomic.LoadInt32(&callCount))
+
+	result, err = client.Query(context.Background(), newCacheRequest(t, 4, "example.com.", dns.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, uint32(30), result.Answer[0].Header().Ttl)
+	require.Equal(t, int32(3), atomic.LoadInt32(&callCount))
+}
+
+func TestCacheDNSClientServeStaleServerFailure(t *testing.T) {
+	clock := newMockClock()
+	callCount := 0
+	rcode := dns.RcodeSuccess
+	client := newCacheDNSClient(newCountingDNSClient(&callCount, func() *dns.Msg {
+		msg := newAnswerDNSMsg(30)
+		msg.Rcode = rcode
+		return msg
+	}), 10, withCacheServeStale(time.Hour))
+	client.now = clock.Now
+
+	_, err := client.Query(context.Background(), newCacheRequest(t, 1, "example.com.", dns.TypeA))
+	require.NoError(t, err)
+
+	rcode = dns.RcodeServerFailure
+	clock.Add(time.Minute)
+	result, err := client.Query(context.Background(), newCacheRequest(t, 1, "example.com.", dns.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, result.Rcode)
+	require.Equal(t, uint32(staleTTL), result.Answer[0].Header().Ttl)
+}
+
+func TestCacheDNSClientServeStaleExpired(t *testing.T) {
+	clock := newMockClock()
+	callCount := 0
+	fail := false
+	client := newCacheDNSClient(mockDNSClientFunc(func(_ context.Context, dnsreq []byte) (*dns.Msg, error) {
+		callCount++
+		if fail {
+			return nil, errors.New("upstream error")
+		}
+		return newAnswerDNSMsg(30), nil
+	}), 10, withCacheServeStale(time.Minute))
+	client.now = clock.Now
+
+	_, err := client.Query(context.Background(), newCacheRequest(t, 1, "example.com.", dns.TypeA))
+	require.NoError(t, err)
+
+	fail = true
+	clock.Add(30*time.Second + time.Minute)
+	_, err = client.Query(context.Background(), newCacheRequest(t, 1, "example.com.", dns.TypeA))
+	require.Error(t, err, "stale response must not be served after the serve_stale duration")
+	require.Equal(t, 2, callCount)
+}
+
+func TestCacheDNSClientWithoutServeStale(t *testing.T) {
+	clock := newMockClock()
+	fail := false
+	client := newCacheDNSClient(mockDNSClientFunc(func(_ context.Context, dnsreq []byte) (*dns.Msg, error) {
+		if fail {
+			return nil, errors.New("upstream error")
+		}
+		return newAnswerDNSMsg(30), nil
+	}), 10)
+	client.now = clock.Now
+
+	_, err := client.Query(context.Background(), newCacheRequest(t, 1, "example.com.", dns.TypeA))
+	require.NoError(t, err)
+
+	fail = true
+	clock.Add(time.Minute)
+	_, err = client.Query(context.Background(), newCacheRequest(t, 1, "example.com.", dns.TypeA))
+	require.Error(t, err)
+}
+
+func TestCacheDNSClientPrefetch(t *testing.T) {
+	clock := newMockClock()
+	var callCount int32
+	client := newCacheDNSClient(mockDNSClientFunc(func(_ context.Context, dnsreq []byte) (*dns.Msg, error) {
+		atomic.AddInt32(&callCount, 1)
+		return newAnswerDNSMsg(100), nil
+	}), 10, withCachePrefetch(2, time.Minute, 10))
+	client.now = clock.Now
+
+	prefetches := testutil.ToFloat64(CachePrefetchCount)
+
+	_, err := client.Query(context.Background(), newCacheRequest(t, 1, "example.com.", dns.TypeA))
+	require.NoError(t, err)
+
+	// the entry is not popular yet
+	clock.Add(91 * time.Second)
+	_, err = client.Query(context.Background(), newCacheRequest(t, 1, "example.com.", dns.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, int32(1), atomic.LoadInt32(&callCount))
+
+	result, err := client.Query(context.Background(), newCacheRequest(t, 1, "example.com.", dns.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, uint32(9), result.Answer[0].Header().Ttl, "cached response must be returned immediately")
+	require.Eventually(t, func() bool {
+		entry, ok := client.get(cacheKey(newRequestDNSMsg(), nil))
+		return ok && entry.expires.Sub(clock.Now()) == 100*time.Second
+	}, time.Second, 10*time.Millisecond, "popular entry must be refreshed in the background")
+	require.Equal(t, int32(2), atomic.LoadInt32(&callCount))
+	require.Equal(t, prefetches+1, testutil.ToFloat64(CachePrefetchCount))
+
+	// the refreshed entry keeps its popularity
+	clock.Add(50 * time.Second)
+	_, err = client.Query(context.Background(), newCacheRequest(t, 1, "example.com.", dns.TypeA))
+	require.NoError(t, err)
+	clock.Add(41 * time.Second)
+	_, err = client.Query(context.Background(), newCacheRequest(t, 1, "example.com.", dns.TypeA))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&callCount) == 3
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestCacheDNSClientPrefetchNotPopular(t *testing.T) {
+	clock := newMockClock()
+	callCount := 0
+	client := newCacheDNSClient(newCountingDNSClient(&callCount, func() *dns.Msg {
+		return newAnswerDNSMsg(100)
+	}), 10, withCachePrefetch(2, 10*time.Second, 10))
+	client.now = clock.Now
+
+	_, err := client.Query(context.Background(), newCacheRequest(t, 1, "example.com.", dns.TypeA))
+	require.NoError(t, err)
+	clock.Add(50 * time.Second)
+	_, err = client.Query(context.Background(), newCacheRequest(t, 1, "example.com.", dns.TypeA))
+	require.NoError(t, err)
+	// the previous hit is older than the prefetch duration
+	clock.Add(45 * time.Second)
+	_, err = client.Query(context.Background(), newCacheRequest(t, 1, "example.com.", dns.TypeA))
+	require.NoError(t, err)
+
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, 1, callCount)
+}
@@ -0,0 +1,129 @@
+package https
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/fnv"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// coalesceDNSClient is a DNS client that coalesces identical concurrent queries,
+// so that they share a single query of the underlying client.
+type coalesceDNSClient struct {
+	client  dnsClient
+	subnets upstreamSubnets
+
+	mu    sync.Mutex
+	calls map[uint64]*coalesceCall
+}
+
+// coalesceCall is an in-flight query of the underlying client.
+type coalesceCall struct {
+	done chan struct{}
+	// dups is the number of queries waiting for the result
+	dups int
+	// msg is the response shared between waiting queries
+	msg *dns.Msg
+	err error
+}
+
+func newCoalesceDNSClient(client dnsClient, opts ...coalesceDNSClientOption) *coalesceDNSClient {
+	c := &coalesceDNSClient{
+		client: client,
+		calls:  make(map[uint64]*coalesceCall),
+	}
+	// option pattern
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+type coalesceDNSClientOption func(c *coalesceDNSClient)
+
+// withCoalesceUpstreamSubnets sets the add policies of the upstreams, so that only queries
+// of clients from the same subnet that the upstreams get are coalesced.
+func withCoalesceUpstreamSubnets(subnets upstreamSubnets) coalesceDNSClientOption {
+	return func(c *coalesceDNSClient) {
+		c.subnets = subnets
+	}
+}
+
+func (c *coalesceDNSClient) Query(ctx context.Context, dnsreq []byte) (r *dns.Msg, err error) {
+	req, err := unpackRequest(ctx, dnsreq)
+	if err != nil {
+		return c.client.Query(ctx, dnsreq)
+	}
+	CoalesceQueryCount.Add(1)
+
+	key := coalesceKey(req, c.subnets.subnets(ctx, req))
+	c.mu.Lock()
+	if call, ok := c.calls[key]; ok {
+		call.dups++
+		c.mu.Unlock()
+		CoalesceSharedCount.Add(1)
+		return call.wait(ctx, req)
+	}
+	call := &coalesceCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	// decorator pattern
+	r, err = c.client.Query(ctx, dnsreq)
+
+	c.mu.Lock()
+	delete(c.calls, key)
+	if call.dups > 0 && err == nil {
+		// the caller owns r and may modify it
+		call.msg = r.Copy()
+	}
+	call.err = err
+	c.mu.Unlock()
+	close(call.done)
+	return
+}
+
+// wait waits for the result of the call and returns a copy of the response for the given request.
+func (call *coalesceCall) wait(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-call.done:
+	}
+	if call.err != nil {
+		return nil, call.err
+	}
+	r := call.msg.Copy()
+	r.Id = req.Id
+	// keep the case of the query name of the request
+	r.Question = req.Question
+	return r, nil
+}
+
+// coalesceKey returns the hash of the query name, type, class, the RD and CD flags,
+// the DNSSEC OK bit, the Client Subnet option of the request and the Client Subnet options the upstreams send,
+// see upstreamSubnets.
+func coalesceKey(req *dns.Msg, subnets []*dns.EDNS0_SUBNET) uint64 {
+	q := req.Question[0]
+	h := fnv.New64a()
+	h.Write([]byte(strings.ToLower(q.Name)))
+	var buf [5]byte
+	binary.BigEndian.PutUint16(buf[0:], q.Qtype)
+	binary.BigEndian.PutUint16(buf[2:], q.Qclass)
+	if req.RecursionDesired {
+		buf[4] |= 1
+	}
+	if req.CheckingDisabled {
+		buf[4] |= 1 << 1
+	}
+	if opt := req.IsEdns0(); opt != nil && opt.Do() {
+		buf[4] |= 1 << 2
+	}
+	h.Write(buf[:])
+	hashSubnet(h, req)
+	hashSubnets(h, subnets)
+	return h.Sum64()
+}
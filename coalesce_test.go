@@ -0,0 +1,156 @@
+package https
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// newBlockingDNSClient returns a DNS client that waits for release to be closed before responding.
+func newBlockingDNSClient(callCount *int32, release chan struct{}, err error) dnsClient {
+	return mockDNSClientFunc(func(_ context.Context, dnsreq []byte) (*dns.Msg, error) {
+		atomic.AddInt32(callCount, 1)
+		<-release
+		if err != nil {
+			return nil, err
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(dnsreq); err != nil {
+			return nil, err
+		}
+		msg := newExpectedDNSMsg()
+		msg.Id = req.Id
+		return msg, nil
+	})
+}
+
+// waitDups waits until count queries are waiting for the in-flight query.
+func waitDups(t *testing.T, c *coalesceDNSClient, count int) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, call := range c.calls {
+			if call.dups == count {
+				return true
+			}
+		}
+		return false
+	}, time.Second, time.Millisecond)
+}
+
+func TestCoalesceDNSClient(t *testing.T) {
+	var callCount int32
+	release := make(chan struct{})
+	client := newCoalesceDNSClient(newBlockingDNSClient(&callCount, release, nil))
+
+	queries := testutil.ToFloat64(CoalesceQueryCount)
+	shared := testutil.ToFloat64(CoalesceSharedCount)
+
+	names := []string{"example.com.", "EXAMPLE.com.", "example.COM."}
+	results := make([]*dns.Msg, len(names))
+	errs := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			results[i], errs[i] = client.Query(context.Background(), newCacheRequest(t, uint16(i+1), name, dns.TypeA))
+		}(i, name)
+		if i == 0 {
+			require.Eventually(t, func() bool {
+				return atomic.LoadInt32(&callCount) == 1
+			}, time.Second, time.Millisecond)
+		}
+	}
+	waitDups(t, client, len(names)-1)
+	close(release)
+	wg.Wait()
+
+	require.Equal(t, int32(1), atomic.LoadInt32(&callCount), "identical queries must share one upstream query")
+	for i, r := range results {
+		require.NoError(t, errs[i])
+		require.Equal(t, uint16(i+1), r.Id)
+		require.Equal(t, names[i], r.Question[0].Name)
+		require.Len(t, r.Answer, 1)
+	}
+	require.NotSame(t, results[1], results[2], "each query must get its own copy of the response")
+	require.Equal(t, queries+3, testutil.ToFloat64(CoalesceQueryCount))
+	require.Equal(t, shared+2, testutil.ToFloat64(CoalesceSharedCount))
+}
+
+func TestCoalesceDNSClientError(t *testing.T) {
+	var callCount int32
+	release := make(chan struct{})
+	upstreamErr := errors.New("upstream error")
+	client := newCoalesceDNSClient(newBlockingDNSClient(&callCount, release, upstreamErr))
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := client.Query(context.Background(), newCacheRequest(t, 1, "example.com.", dns.TypeA))
+			errs <- err
+		}()
+		if i == 0 {
+			require.Eventually(t, func() bool {
+				return atomic.LoadInt32(&callCount) == 1
+			}, time.Second, time.Millisecond)
+		}
+	}
+	waitDups(t, client, 1)
+	close(release)
+
+	require.ErrorIs(t, <-errs, upstreamErr)
+	require.ErrorIs(t, <-errs, upstreamErr)
+	require.Equal(t, int32(1), atomic.LoadInt32(&callCount))
+}
+
+func TestCoalesceDNSClientDifferentQueries(t *testing.T) {
+	var callCount int32
+	release := make(chan struct{})
+	close(release)
+	client := newCoalesceDNSClient(newBlockingDNSClient(&callCount, release, nil))
+
+	_, err := client.Query(context.Background(), newCacheRequest(t, 1, "example.com.", dns.TypeA))
+	require.NoError(t, err)
+	_, err = client.Query(context.Background(), newCacheRequest(t, 1, "example.com.", dns.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, int32(2), atomic.LoadInt32(&callCount), "sequential queries must not be coalesced")
+
+	req := newRequestDNSMsg()
+	key := coalesceKey(req, nil)
+	req.CheckingDisabled = true
+	require.NotEqual(t, key, coalesceKey(req, nil))
+	req = newRequestDNSMsg()
+	req.SetEdns0(4096, true)
+	require.NotEqual(t, key, coalesceKey(req, nil))
+	req = newRequestDNSMsg()
+	req.Question[0].Qtype = dns.TypeAAAA
+	require.NotEqual(t, key, coalesceKey(req, nil))
+}
+
+func TestCoalesceDNSClientCancelledWaiter(t *testing.T) {
+	var callCount int32
+	release := make(chan struct{})
+	defer close(release)
+	client := newCoalesceDNSClient(newBlockingDNSClient(&callCount, release, nil))
+
+	go func() {
+		_, _ = client.Query(context.Background(), newCacheRequest(t, 1, "example.com.", dns.TypeA))
+	}()
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&callCount) == 1
+	}, time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := client.Query(ctx, newCacheRequest(t, 2, "example.com.", dns.TypeA))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
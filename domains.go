@@ -0,0 +1,307 @@
+package https
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// regexPatternPrefix is the prefix of domain patterns that are regular expressions.
+const regexPatternPrefix = "regex:"
+
+// domainMatcher matches domain names against a list of patterns:
+//
+//   - names, e.g. example.org, match the name and its subdomains
+//   - wildcards, e.g. *.internal.*, match names where each * stands for one or more labels
+//   - regular expressions prefixed with regex:, e.g. regex:^ads[0-9]*\., match lowercase fully qualified names
+//
+// Names are kept in a suffix trie, so that large lists are matched in time proportional
+// to the number of labels of the name.
+type domainMatcher struct {
+	names    *suffixTrie
+	patterns []*regexp.Regexp
+}
+
+// newDomainMatcher returns a matcher of the normalized patterns, see normalizeDomainPattern.
+func newDomainMatcher(patterns []string) (*domainMatcher, error) {
+	m := &domainMatcher{names: newSuffixTrie()}
+	for _, p := range patterns {
+		re, err := compileDomainPattern(p)
+		if err != nil {
+			return nil, err
+		}
+		if re == nil {
+			m.names.Add(p)
+			continue
+		}
+		m.patterns = append(m.patterns, re)
+	}
+	return m, nil
+}
+
+// Match reports whether the name matches any of the patterns.
+func (m *domainMatcher) Match(name string) bool {
+	name = strings.ToLower(dns.Fqdn(name))
+	if m.names.Match(name) {
+		return true
+	}
+	for _, re := range m.patterns {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeDomainPattern checks the pattern and returns it in the form used by domainMatcher:
+// names are normalized as the FROM name, wildcards are converted to lowercase fully qualified names.
+func normalizeDomainPattern(pattern string) (string, error) {
+	switch {
+	case strings.HasPrefix(pattern, regexPatternPrefix):
+		if _, err := regexp.Compile(strings.TrimPrefix(pattern, regexPatternPrefix)); err != nil {
+			return "", err
+		}
+		return pattern, nil
+	case strings.Contains(pattern, "*"):
+		pattern = strings.ToLower(dns.Fqdn(pattern))
+		if _, ok := dns.IsDomainName(strings.ReplaceAll(pattern, "*", "x")); !ok {
+			return "", fmt.Errorf("invalid wildcard '%s'", pattern)
+		}
+		return pattern, nil
+	default:
+		return parseHost(pattern)
+	}
+}
+
+// compileDomainPattern returns the regular expression of the regex or wildcard pattern
+// or nil if the pattern is a name.
+func compileDomainPattern(pattern string) (*regexp.Regexp, error) {
+	if strings.HasPrefix(pattern, regexPatternPrefix) {
+		return regexp.Compile(strings.TrimPrefix(pattern, regexPatternPrefix))
+	}
+	if !strings.Contains(pattern, "*") {
+		return nil, nil
+	}
+	parts := strings.Split(pattern, "*")
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+	return regexp.Compile(`^` + strings.Join(parts, `[^.]+(?:\.[^.]+)*`) + `$`)
+}
+
+// domainList is a domainMatcher of the patterns and the patterns read from the files.
+// When started, it polls the files for changes and atomically replaces the matcher
+// with the matcher of the new patterns, so that in-flight queries are not interrupted.
+type domainList struct {
+	// name is the name of the list in logs and metrics
+	name     string
+	patterns []string
+	paths    []string
+	interval time.Duration
+
+	matcher atomic.Pointer[domainMatcher]
+	// stamps are the states of the files at the last reload attempt
+	stamps []fileStamp
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// fileStamp is the state of a file used to detect its changes.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// newDomainList returns a list of the normalized patterns and the patterns read from the files
+// that are polled for changes every interval. Files are not polled if interval is zero.
+func newDomainList(name string, patterns, paths []string, interval time.Duration) (*domainList, error) {
+	l := &domainList{name: name, patterns: patterns, paths: paths, interval: interval}
+	l.stamps = l.stat()
+	m, err := l.load()
+	if err != nil {
+		return nil, err
+	}
+	l.matcher.Store(m)
+	return l, nil
+}
+
+// Match reports whether the name matches any of the patterns.
+func (l *domainList) Match(name string) bool {
+	return l.matcher.Load().Match(name)
+}
+
+// Start starts the goroutine polling the files for changes.
+func (l *domainList) Start() {
+	if l.interval == 0 || len(l.paths) == 0 {
+		return
+	}
+	l.stop = make(chan struct{})
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		ticker := time.NewTicker(l.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-l.stop:
+				return
+			case <-ticker.C:
+				l.reload()
+			}
+		}
+	}()
+}
+
+// Stop stops the polling goroutine and waits for it to exit.
+func (l *domainList) Stop() {
+	if l.stop == nil {
+		return
+	}
+	close(l.stop)
+	l.wg.Wait()
+}
+
+// reload replaces the matcher if any of the files has changed since the last reload attempt.
+// The current matcher is kept if the files can't be read.
+func (l *domainList) reload() {
+	stamps := l.stat()
+	if equalFileStamps(stamps, l.stamps) {
+		return
+	}
+	l.stamps = stamps
+	m, err := l.load()
+	if err != nil {
+		DomainListReloadFailCount.WithLabelValues(l.name).Add(1)
+		log.Errorf("Failed to reload %s list: %s", l.name, err)
+		return
+	}
+	l.matcher.Store(m)
+	DomainListReloadCount.WithLabelValues(l.name).Add(1)
+	log.Infof("Reloaded %s list", l.name)
+}
+
+func (l *domainList) load() (*domainMatcher, error) {
+	patterns := append([]string(nil), l.patterns...)
+	for _, path := range l.paths {
+		filePatterns, err := readDomainList(path)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, filePatterns...)
+	}
+	return newDomainMatcher(patterns)
+}
+
+// stat returns the states of the files, the zero state for the files that can't be stat'ed.
+func (l *domainList) stat() []fileStamp {
+	stamps := make([]fileStamp, len(l.paths))
+	for i, path := range l.paths {
+		if fi, err := os.Stat(path); err == nil {
+			stamps[i] = fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+		}
+	}
+	return stamps
+}
+
+func equalFileStamps(a, b []fileStamp) bool {
+	for i := range a {
+		if !a[i].modTime.Equal(b[i].modTime) || a[i].size != b[i].size {
+			return false
+		}
+	}
+	return true
+}
+
+// readDomainList reads the patterns from the file, one per line.
+// Empty lines and comments starting with # are skipped.
+func readDomainList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		pattern, err := normalizeDomainPattern(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, scanner.Err()
+}
+
+// suffixTrie is a trie of domain names by their labels from right to left.
+type suffixTrie struct {
+	root *suffixTrieNode
+}
+
+type suffixTrieNode struct {
+	children map[string]*suffixTrieNode
+	// terminal is true if the node is the last label of an added name
+	terminal bool
+}
+
+func newSuffixTrie() *suffixTrie {
+	return &suffixTrie{root: &suffixTrieNode{}}
+}
+
+// Add adds the lowercase fully qualified name to the trie.
+func (t *suffixTrie) Add(name string) {
+	node := t.root
+	labels := dns.SplitDomainName(name)
+	for i := len(labels) - 1; i >= 0; i-- {
+		if node.children == nil {
+			node.children = make(map[string]*suffixTrieNode)
+		}
+		child, ok := node.children[labels[i]]
+		if !ok {
+			child = &suffixTrieNode{}
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+	node.terminal = true
+}
+
+// Match reports whether the lowercase fully qualified name is equal to or a subdomain of an added name.
+func (t *suffixTrie) Match(name string) bool {
+	node := t.root
+	if node.terminal {
+		return true
+	}
+	end := len(name)
+	if end > 0 && name[end-1] == '.' {
+		end--
+	}
+	for end > 0 {
+		start := strings.LastIndexByte(name[:end], '.') + 1
+		child, ok := node.children[name[start:end]]
+		if !ok {
+			return false
+		}
+		if child.terminal {
+			return true
+		}
+		node = child
+		end = start - 1
+	}
+	return false
+}
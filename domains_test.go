@@ -0,0 +1,161 @@
+package https
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDomainMatcher(t *testing.T) {
+	m, err := newDomainMatcher([]string{
+		"example.org.",
+		"corp.example.com.",
+		"*.internal.*.",
+		"ads-*.example.net.",
+		`regex:^tracker[0-9]+\.`,
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		expected bool
+	}{
+		{name: "example.org.", expected: true},
+		{name: "www.Example.ORG.", expected: true},
+		{name: "a.b.example.org", expected: true},
+		{name: "notexample.org.", expected: false},
+		{name: "org.", expected: false},
+		{name: "corp.example.com.", expected: true},
+		{name: "host.corp.example.com.", expected: true},
+		{name: "example.com.", expected: false},
+		{name: "host.internal.corp.", expected: true},
+		{name: "a.b.internal.corp.example.", expected: true},
+		{name: "internal.corp.", expected: false},
+		{name: "host.internal.", expected: false},
+		{name: "ads-1.example.net.", expected: true},
+		{name: "ads-a.b.example.net.", expected: true},
+		{name: "ads.example.net.", expected: false},
+		{name: "tracker42.example.com.", expected: true},
+		{name: "tracker.example.com.", expected: false},
+		{name: "www.tracker42.example.com.", expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expected, m.Match(tt.name))
+		})
+	}
+}
+
+func TestDomainMatcherRoot(t *testing.T) {
+	m, err := newDomainMatcher([]string{"."})
+	require.NoError(t, err)
+	require.True(t, m.Match("example.org."))
+}
+
+func TestDomainMatcherInvalidRegex(t *testing.T) {
+	_, err := newDomainMatcher([]string{"regex:("})
+	require.Error(t, err)
+}
+
+func TestNormalizeDomainPattern(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		expected string
+	}{
+		{pattern: "Example.org", expected: "example.org."},
+		{pattern: "https://example.org", expected: "example.org."},
+		{pattern: "*.Internal.*", expected: "*.internal.*."},
+		{pattern: `regex:^ads\.`, expected: `regex:^ads\.`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			result, err := normalizeDomainPattern(tt.pattern)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, result)
+		})
+	}
+
+	_, err := normalizeDomainPattern("regex:[")
+	require.Error(t, err)
+	_, err = normalizeDomainPattern("*..example.org")
+	require.Error(t, err)
+}
+
+func TestReadDomainList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "except.txt")
+	content := "# internal names\nexample.org\n\n  *.internal.*  # wildcard\nregex:^ads\\.\n"
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	patterns, err := readDomainList(path)
+	require.NoError(t, err)
+	require.Equal(t, []string{"example.org.", "*.internal.*.", `regex:^ads\.`}, patterns)
+}
+
+func TestReadDomainListError(t *testing.T) {
+	_, err := readDomainList(filepath.Join(t.TempDir(), "missing.txt"))
+	require.Error(t, err)
+
+	path := filepath.Join(t.TempDir(), "except.txt")
+	require.NoError(t, os.WriteFile(path, []byte("example.org\nregex:(\n"), 0o600))
+	_, err = readDomainList(path)
+	require.ErrorContains(t, err, "except.txt:2")
+}
+
+func TestDomainListReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "list.txt")
+	require.NoError(t, os.WriteFile(path, []byte("example.org\n"), 0o600))
+
+	l, err := newDomainList("except", []string{"example.net."}, []string{path}, time.Hour)
+	require.NoError(t, err)
+	require.True(t, l.Match("example.org."))
+	require.True(t, l.Match("example.net."))
+	require.False(t, l.Match("example.com."))
+
+	// unchanged file is not reloaded
+	l.reload()
+	require.True(t, l.Match("example.org."))
+
+	require.NoError(t, os.WriteFile(path, []byte("example.com\n"), 0o600))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+	l.reload()
+	require.False(t, l.Match("example.org."))
+	require.True(t, l.Match("example.net."))
+	require.True(t, l.Match("example.com."))
+
+	// invalid file keeps the current list
+	require.NoError(t, os.WriteFile(path, []byte("regex:(\n"), 0o600))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(2*time.Minute)))
+	l.reload()
+	require.True(t, l.Match("example.com."))
+
+	// removed file keeps the current list
+	require.NoError(t, os.Remove(path))
+	l.reload()
+	require.True(t, l.Match("example.com."))
+}
+
+func TestDomainListStartStop(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "list.txt")
+	require.NoError(t, os.WriteFile(path, []byte("example.org\n"), 0o600))
+
+	l, err := newDomainList("from", nil, []string{path}, 10*time.Millisecond)
+	require.NoError(t, err)
+	l.Start()
+	defer l.Stop()
+
+	require.NoError(t, os.WriteFile(path, []byte("example.com\n"), 0o600))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+	require.Eventually(t, func() bool {
+		return l.Match("example.com.") && !l.Match("example.org.")
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestDomainListStopNotStarted(t *testing.T) {
+	l, err := newDomainList("from", []string{"example.org."}, nil, time.Second)
+	require.NoError(t, err)
+	l.Start()
+	l.Stop()
+}
@@ -0,0 +1,216 @@
+package https
+
+import (
+	"context"
+	"hash"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	ecsStrip       = "strip"
+	ecsPassthrough = "passthrough"
+	ecsAdd         = "add"
+
+	// RFC7871 Section 11.1:
+	// By default, the SOURCE PREFIX-LENGTH SHOULD be set to 24 for IPv4 and 56 for IPv6.
+	defaultECSPrefix4 = 24
+	defaultECSPrefix6 = 56
+)
+
+// ecsPolicy defines how the EDNS Client Subnet option (RFC 7871) of upstream queries is set.
+type ecsPolicy struct {
+	// mode is one of ecsStrip, ecsPassthrough or ecsAdd
+	mode    string
+	prefix4 uint8
+	prefix6 uint8
+}
+
+// apply rewrites the Client Subnet option of the message according to the policy.
+// With ecsAdd, the option is set to the client address truncated to the prefix length of its family.
+// The option of the client that asked not to include its address, i.e. with zero source prefix length,
+// is kept as is, as well as the option of the message without a known client address.
+func (p *ecsPolicy) apply(m *dns.Msg, ip net.IP) {
+	o, _ := findOption(m, dns.EDNS0SUBNET).(*dns.EDNS0_SUBNET)
+	if uo := p.upstreamSubnet(o, ip); uo != o {
+		setSubnet(m, uo)
+	}
+}
+
+// upstreamSubnet returns the Client Subnet option of the upstream query according to the policy
+// for the client option o and the client address ip, nil means no option.
+func (p *ecsPolicy) upstreamSubnet(o *dns.EDNS0_SUBNET, ip net.IP) *dns.EDNS0_SUBNET {
+	switch p.mode {
+	case ecsStrip:
+		return nil
+	case ecsAdd:
+		if (o != nil && o.SourceNetmask == 0) || ip == nil {
+			return o
+		}
+		return p.subnet(ip)
+	}
+	return o
+}
+
+func (p *ecsPolicy) subnet(ip net.IP) *dns.EDNS0_SUBNET {
+	o := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET}
+	if ip4 := ip.To4(); ip4 != nil {
+		o.Family = 1
+		o.SourceNetmask = p.prefix4
+		o.Address = ip4.Mask(net.CIDRMask(int(p.prefix4), net.IPv4len*8))
+	} else {
+		o.Family = 2
+		o.SourceNetmask = p.prefix6
+		o.Address = ip.Mask(net.CIDRMask(int(p.prefix6), net.IPv6len*8))
+	}
+	return o
+}
+
+// setSubnet replaces the Client Subnet option of the message with o or removes it if o is nil.
+func setSubnet(m *dns.Msg, o *dns.EDNS0_SUBNET) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		if o == nil {
+			return
+		}
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		opt = m.IsEdns0()
+	}
+	removeOption(opt, dns.EDNS0SUBNET)
+	if o != nil {
+		opt.Option = append(opt.Option, o)
+	}
+}
+
+// hashSubnet writes the Client Subnet option of the request to the hash, if any,
+// so that queries for different client subnets are not answered with the same response.
+func hashSubnet(h hash.Hash, req *dns.Msg) {
+	if o, ok := findOption(req, dns.EDNS0SUBNET).(*dns.EDNS0_SUBNET); ok {
+		writeSubnet(h, o)
+	}
+}
+
+// hashSubnets writes the Client Subnet options of the upstream queries to the hash, nil means no option.
+func hashSubnets(h hash.Hash, subnets []*dns.EDNS0_SUBNET) {
+	for _, o := range subnets {
+		if o == nil {
+			h.Write([]byte{0, 0, 0})
+			continue
+		}
+		writeSubnet(h, o)
+	}
+}
+
+func writeSubnet(h hash.Hash, o *dns.EDNS0_SUBNET) {
+	h.Write([]byte{byte(o.Family >> 8), byte(o.Family), o.SourceNetmask})
+	h.Write(o.Address)
+}
+
+// upstreamSubnets are the policies of the upstreams, see ecsDNSClient, which set the Client Subnet
+// option of queries below the cache and the coalescer from the client address or the client option.
+type upstreamSubnets []*ecsPolicy
+
+// newUpstreamSubnets returns the distinct add and passthrough policies of the upstreams
+// or nil if there are none.
+func newUpstreamSubnets(upstreamECS []*ecsPolicy) (s upstreamSubnets) {
+	for _, p := range upstreamECS {
+		if p == nil || p.mode == ecsStrip {
+			continue
+		}
+		found := false
+		for _, sp := range s {
+			found = found || *sp == *p
+		}
+		if !found {
+			s = append(s, p)
+		}
+	}
+	return
+}
+
+// subnets returns the Client Subnet options that the upstreams send for the request of the client in ctx,
+// so that responses for clients from different subnets are not shared.
+func (s upstreamSubnets) subnets(ctx context.Context, req *dns.Msg) []*dns.EDNS0_SUBNET {
+	if len(s) == 0 {
+		return nil
+	}
+	o, ip := originalSubnet(ctx, req), clientIP(ctx)
+	result := make([]*dns.EDNS0_SUBNET, len(s))
+	for i, p := range s {
+		result[i] = p.upstreamSubnet(o, ip)
+	}
+	return result
+}
+
+type clientIPKey struct{}
+
+// withClientIP returns a copy of ctx with the address of the client that sent the query.
+func withClientIP(ctx context.Context, ip net.IP) context.Context {
+	return context.WithValue(ctx, clientIPKey{}, ip)
+}
+
+// clientIP returns the address of the client stored in ctx or nil if there is none,
+// for instance, for background queries.
+func clientIP(ctx context.Context) net.IP {
+	ip, _ := ctx.Value(clientIPKey{}).(net.IP)
+	return ip
+}
+
+type clientSubnetKey struct{}
+
+// withClientSubnet returns a copy of ctx with the Client Subnet option of the client request, nil if it has none.
+// The upstreams with their own ECS policy start from the client option rather than the one set by the ecs property.
+func withClientSubnet(ctx context.Context, o *dns.EDNS0_SUBNET) context.Context {
+	return context.WithValue(ctx, clientSubnetKey{}, o)
+}
+
+// originalSubnet returns the Client Subnet option of the client request stored in ctx
+// or the option of req if there is none in ctx.
+func originalSubnet(ctx context.Context, req *dns.Msg) *dns.EDNS0_SUBNET {
+	if o, ok := ctx.Value(clientSubnetKey{}).(*dns.EDNS0_SUBNET); ok {
+		return o
+	}
+	o, _ := findOption(req, dns.EDNS0SUBNET).(*dns.EDNS0_SUBNET)
+	return o
+}
+
+// withClient returns a copy of ctx with the client address and the client Client Subnet option of from.
+func withClient(ctx, from context.Context) context.Context {
+	ctx = withClientIP(ctx, clientIP(from))
+	if o, ok := from.Value(clientSubnetKey{}).(*dns.EDNS0_SUBNET); ok {
+		ctx = withClientSubnet(ctx, o)
+	}
+	return ctx
+}
+
+// ecsDNSClient is a DNS client that rewrites the Client Subnet option of queries
+// of the underlying upstream client according to the upstream's own policy applied
+// to the client option, see withClientSubnet. Padded queries are padded again to paddingBlockSize.
+type ecsDNSClient struct {
+	client           dnsClient
+	policy           *ecsPolicy
+	paddingBlockSize int
+}
+
+func newECSDNSClient(client dnsClient, policy *ecsPolicy, paddingBlockSize int) *ecsDNSClient {
+	return &ecsDNSClient{client: client, policy: policy, paddingBlockSize: paddingBlockSize}
+}
+
+func (c *ecsDNSClient) Query(ctx context.Context, dnsreq []byte) (r *dns.Msg, err error) {
+	req, err := unpackRequest(ctx, dnsreq)
+	if err != nil {
+		return c.client.Query(ctx, dnsreq)
+	}
+	// the request may be shared with other clients of the chain
+	req = req.Copy()
+	setSubnet(req, c.policy.upstreamSubnet(originalSubnet(ctx, req), clientIP(ctx)))
+	if c.paddingBlockSize > 0 && hasOption(req, dns.EDNS0PADDING) {
+		req = padRequest(req, c.paddingBlockSize)
+	}
+	if dnsreq, err = req.Pack(); err != nil {
+		return
+	}
+	// decorator pattern
+	return c.client.Query(ctx, dnsreq)
+}
@@ -0,0 +1,315 @@
+package https
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func newECSRequestDNSMsg(ip net.IP, prefix uint8) *dns.Msg {
+	msg := newRequestDNSMsg()
+	msg.SetEdns0(4096, false)
+	opt := msg.IsEdns0()
+	family := uint16(1)
+	if ip.To4() == nil {
+		family = 2
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: family, SourceNetmask: prefix, Address: ip})
+	return msg
+}
+
+func requestSubnet(t *testing.T, m *dns.Msg) *dns.EDNS0_SUBNET {
+	t.Helper()
+	o, ok := findOption(m, dns.EDNS0SUBNET).(*dns.EDNS0_SUBNET)
+	require.True(t, ok, "request must have the Client Subnet option")
+	return o
+}
+
+func TestECSPolicyApply(t *testing.T) {
+	add := &ecsPolicy{mode: ecsAdd, prefix4: 24, prefix6: 56}
+
+	t.Run("Strip", func(t *testing.T) {
+		msg := newECSRequestDNSMsg(net.IPv4(192, 0, 2, 0), 24)
+		(&ecsPolicy{mode: ecsStrip}).apply(msg, net.IPv4(10, 0, 0, 1))
+		require.NotNil(t, msg.IsEdns0())
+		require.False(t, hasOption(msg, dns.EDNS0SUBNET))
+	})
+
+	t.Run("Passthrough", func(t *testing.T) {
+		msg := newECSRequestDNSMsg(net.IPv4(192, 0, 2, 0), 24)
+		(&ecsPolicy{mode: ecsPassthrough}).apply(msg, net.IPv4(10, 0, 0, 1))
+		require.Equal(t, net.IPv4(192, 0, 2, 0), requestSubnet(t, msg).Address)
+	})
+
+	t.Run("AddIPv4", func(t *testing.T) {
+		msg := newRequestDNSMsg()
+		add.apply(msg, net.ParseIP("10.1.2.3"))
+		o := requestSubnet(t, msg)
+		require.Equal(t, uint16(1), o.Family)
+		require.Equal(t, uint8(24), o.SourceNetmask)
+		require.Equal(t, "10.1.2.0", o.Address.String())
+		packMsg(t, msg)
+	})
+
+	t.Run("AddIPv6", func(t *testing.T) {
+		msg := newRequestDNSMsg()
+		add.apply(msg, net.ParseIP("2001:db8:1:2ff::1"))
+		o := requestSubnet(t, msg)
+		require.Equal(t, uint16(2), o.Family)
+		require.Equal(t, uint8(56), o.SourceNetmask)
+		require.Equal(t, "2001:db8:1:200::", o.Address.String())
+		packMsg(t, msg)
+	})
+
+	t.Run("AddReplacesClientSubnet", func(t *testing.T) {
+		msg := newECSRequestDNSMsg(net.IPv4(192, 0, 2, 0), 24)
+		add.apply(msg, net.ParseIP("10.1.2.3"))
+		require.Len(t, msg.IsEdns0().Option, 1)
+		require.Equal(t, "10.1.2.0", requestSubnet(t, msg).Address.String())
+	})
+
+	t.Run("AddKeepsClientOptOut", func(t *testing.T) {
+		msg := newECSRequestDNSMsg(net.IPv4zero, 0)
+		add.apply(msg, net.ParseIP("10.1.2.3"))
+		require.Equal(t, uint8(0), requestSubnet(t, msg).SourceNetmask)
+	})
+
+	t.Run("AddWithoutClientIP", func(t *testing.T) {
+		msg := newRequestDNSMsg()
+		add.apply(msg, nil)
+		require.False(t, hasOption(msg, dns.EDNS0SUBNET))
+	})
+}
+
+func TestECSDNSClient(t *testing.T) {
+	var upstreamReq *dns.Msg
+	client := newECSDNSClient(mockDNSClientFunc(func(_ context.Context, dnsreq []byte) (*dns.Msg, error) {
+		upstreamReq = new(dns.Msg)
+		require.NoError(t, upstreamReq.Unpack(dnsreq))
+		return newExpectedDNSMsg(), nil
+	}), &ecsPolicy{mode: ecsAdd, prefix4: 16, prefix6: 48}, 128)
+
+	ctx := withClientIP(context.Background(), net.ParseIP("10.1.2.3"))
+	req := newRequestDNSMsg()
+	data := packMsg(t, req)
+	_, err := client.Query(withRequest(ctx, data, req), data)
+	require.NoError(t, err)
+	require.Equal(t, "10.1.0.0", requestSubnet(t, upstreamReq).Address.String())
+	require.False(t, hasOption(upstreamReq, dns.EDNS0PADDING))
+	require.Nil(t, req.IsEdns0(), "the shared request must not be modified")
+
+	data = packMsg(t, padRequest(newRequestDNSMsg(), 128))
+	_, err = client.Query(ctx, data)
+	require.NoError(t, err)
+	require.Equal(t, "10.1.0.0", requestSubnet(t, upstreamReq).Address.String())
+	upstreamData := packMsg(t, upstreamReq)
+	require.Zero(t, len(upstreamData)%128, "padded request must be padded again")
+}
+
+func TestHTTPSECS(t *testing.T) {
+	var upstreamReq *dns.Msg
+	dnsClient := mockDNSClientFunc(func(ctx context.Context, dnsreq []byte) (*dns.Msg, error) {
+		require.Equal(t, "10.240.0.1", clientIP(ctx).String())
+		upstreamReq = new(dns.Msg)
+		require.NoError(t, upstreamReq.Unpack(dnsreq))
+		resp := newExpectedDNSMsg()
+		resp.Extra = append(resp.Extra, upstreamReq.IsEdns0())
+		return resp, nil
+	})
+
+	t.Run("Add", func(t *testing.T) {
+		h := newHTTPS(".", dnsClient, withECS(&ecsPolicy{mode: ecsAdd, prefix4: 24, prefix6: 56}))
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		req := newRequestDNSMsg()
+		_, err := h.ServeDNS(context.Background(), rec, req)
+		require.NoError(t, err)
+		require.Equal(t, "10.240.0.0", requestSubnet(t, upstreamReq).Address.String())
+		require.Nil(t, req.IsEdns0(), "the client request must not be modified")
+		require.Nil(t, rec.Msg.IsEdns0(), "the client must not get the OPT record it didn't ask for")
+	})
+
+	t.Run("Strip", func(t *testing.T) {
+		h := newHTTPS(".", dnsClient, withECS(&ecsPolicy{mode: ecsStrip}))
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		_, err := h.ServeDNS(context.Background(), rec, newECSRequestDNSMsg(net.IPv4(192, 0, 2, 0), 24))
+		require.NoError(t, err)
+		require.False(t, hasOption(upstreamReq, dns.EDNS0SUBNET))
+		require.NotNil(t, rec.Msg.IsEdns0())
+	})
+
+	t.Run("Passthrough", func(t *testing.T) {
+		h := newHTTPS(".", dnsClient, withECS(&ecsPolicy{mode: ecsPassthrough}))
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		_, err := h.ServeDNS(context.Background(), rec, newECSRequestDNSMsg(net.IPv4(192, 0, 2, 0), 24))
+		require.NoError(t, err)
+		require.Equal(t, net.IPv4(192, 0, 2, 0).To4(), requestSubnet(t, upstreamReq).Address.To4())
+		require.True(t, hasOption(rec.Msg, dns.EDNS0SUBNET))
+	})
+}
+
+func TestHTTPSUpstreamECS(t *testing.T) {
+	clientSubnet := net.IPv4(192, 0, 2, 0).To4()
+	tests := []struct {
+		name     string
+		ecs      *ecsPolicy
+		upstream *ecsPolicy
+		req      *dns.Msg
+		// the expected upstream Client Subnet address, empty if there is no option
+		expected string
+	}{
+		{
+			name:     "StripPassthrough",
+			ecs:      &ecsPolicy{mode: ecsStrip},
+			upstream: &ecsPolicy{mode: ecsPassthrough},
+			req:      newECSRequestDNSMsg(clientSubnet, 24),
+			expected: "192.0.2.0",
+		},
+		{
+			name:     "AddPassthrough",
+			ecs:      &ecsPolicy{mode: ecsAdd, prefix4: 24, prefix6: 56},
+			upstream: &ecsPolicy{mode: ecsPassthrough},
+			req:      newECSRequestDNSMsg(clientSubnet, 24),
+			expected: "192.0.2.0",
+		},
+		{
+			name:     "AddPassthroughWithoutClientOption",
+			ecs:      &ecsPolicy{mode: ecsAdd, prefix4: 24, prefix6: 56},
+			upstream: &ecsPolicy{mode: ecsPassthrough},
+			req:      newRequestDNSMsg(),
+		},
+		{
+			name:     "PassthroughStrip",
+			ecs:      &ecsPolicy{mode: ecsPassthrough},
+			upstream: &ecsPolicy{mode: ecsStrip},
+			req:      newECSRequestDNSMsg(clientSubnet, 24),
+		},
+		{
+			name:     "StripAdd",
+			ecs:      &ecsPolicy{mode: ecsStrip},
+			upstream: &ecsPolicy{mode: ecsAdd, prefix4: 16, prefix6: 48},
+			req:      newECSRequestDNSMsg(clientSubnet, 24),
+			expected: "10.240.0.0",
+		},
+		{
+			name:     "Add",
+			upstream: &ecsPolicy{mode: ecsAdd, prefix4: 16, prefix6: 48},
+			req:      newRequestDNSMsg(),
+			expected: "10.240.0.0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var upstreamReq *dns.Msg
+			upstream := newECSDNSClient(mockDNSClientFunc(func(_ context.Context, dnsreq []byte) (*dns.Msg, error) {
+				upstreamReq = new(dns.Msg)
+				require.NoError(t, upstreamReq.Unpack(dnsreq))
+				resp := newExpectedDNSMsg()
+				if opt := upstreamReq.IsEdns0(); opt != nil {
+					resp.Extra = append(resp.Extra, opt)
+				}
+				return resp, nil
+			}), tt.upstream, 0)
+			h := newHTTPS(".", newLoadBalanceDNSClient([]dnsClient{upstream}), withECS(tt.ecs))
+
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			_, err := h.ServeDNS(context.Background(), rec, tt.req)
+			require.NoError(t, err)
+			if tt.expected == "" {
+				require.False(t, hasOption(upstreamReq, dns.EDNS0SUBNET))
+			} else {
+				require.Equal(t, tt.expected, requestSubnet(t, upstreamReq).Address.String())
+			}
+			if !hasOption(tt.req, dns.EDNS0SUBNET) {
+				require.False(t, hasOption(rec.Msg, dns.EDNS0SUBNET), "the client must not get the Client Subnet option it didn't ask for")
+			}
+		})
+	}
+}
+
+func TestCacheKeyClientSubnet(t *testing.T) {
+	key := cacheKey(newECSRequestDNSMsg(net.IPv4(10, 0, 0, 0), 24), nil)
+	require.NotEqual(t, cacheKey(newRequestDNSMsg(), nil), key)
+	require.NotEqual(t, cacheKey(newECSRequestDNSMsg(net.IPv4(10, 0, 1, 0), 24), nil), key)
+	require.Equal(t, cacheKey(newECSRequestDNSMsg(net.IPv4(10, 0, 0, 0), 24), nil), key)
+	require.NotEqual(t, coalesceKey(newECSRequestDNSMsg(net.IPv4(10, 0, 1, 0), 24), nil),
+		coalesceKey(newECSRequestDNSMsg(net.IPv4(10, 0, 0, 0), 24), nil))
+}
+
+func TestCacheDNSClientUpstreamSubnets(t *testing.T) {
+	clock := newMockClock()
+	var mu sync.Mutex
+	var subnets []string
+	upstream := newECSDNSClient(mockDNSClientFunc(func(_ context.Context, dnsreq []byte) (*dns.Msg, error) {
+		req := new(dns.Msg)
+		require.NoError(t, req.Unpack(dnsreq))
+		mu.Lock()
+		subnets = append(subnets, requestSubnet(t, req).Address.String())
+		mu.Unlock()
+		return newAnswerDNSMsg(100), nil
+	}), &ecsPolicy{mode: ecsAdd, prefix4: 24, prefix6: 56}, 0)
+	policies := newUpstreamSubnets([]*ecsPolicy{nil, {mode: ecsAdd, prefix4: 24, prefix6: 56}})
+	client := newCacheDNSClient(newCoalesceDNSClient(upstream, withCoalesceUpstreamSubnets(policies)), 10,
+		withCacheUpstreamSubnets(policies), withCachePrefetch(1, time.Minute, 10))
+	client.now = clock.Now
+
+	query := func(ip string) {
+		ctx := withClientIP(context.Background(), net.ParseIP(ip))
+		_, err := client.Query(ctx, newCacheRequest(t, 1, "example.com.", dns.TypeA))
+		require.NoError(t, err)
+	}
+	getSubnets := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), subnets...)
+	}
+
+	query("10.1.1.1")
+	query("10.2.2.2")
+	// the same subnet as the first client
+	query("10.1.1.3")
+	require.Equal(t, []string{"10.1.1.0", "10.2.2.0"}, getSubnets())
+
+	// the prefetched entry is refreshed with the subnet of the client
+	clock.Add(91 * time.Second)
+	query("10.2.2.3")
+	require.Eventually(t, func() bool {
+		return len(getSubnets()) == 3
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, "10.2.2.0", getSubnets()[2])
+}
+
+func TestUpstreamSubnetsKey(t *testing.T) {
+	subnets := newUpstreamSubnets([]*ecsPolicy{
+		{mode: ecsAdd, prefix4: 24, prefix6: 56}, {mode: ecsStrip}, nil, {mode: ecsAdd, prefix4: 24, prefix6: 56},
+	})
+	require.Len(t, subnets, 1)
+	require.Nil(t, newUpstreamSubnets([]*ecsPolicy{nil, {mode: ecsStrip}}))
+
+	req := newRequestDNSMsg()
+	key := func(s upstreamSubnets, ip string, o *dns.EDNS0_SUBNET) uint64 {
+		ctx := withClientSubnet(withClientIP(context.Background(), net.ParseIP(ip)), o)
+		return cacheKey(req, s.subnets(ctx, req))
+	}
+	require.Equal(t, key(subnets, "10.1.1.2", nil), key(subnets, "10.1.1.1", nil))
+	require.NotEqual(t, key(subnets, "10.2.1.1", nil), key(subnets, "10.1.1.1", nil))
+	require.Equal(t, key(nil, "10.2.1.1", nil), key(nil, "10.1.1.1", nil))
+
+	// the client option is sent to passthrough upstreams even if the ecs property strips it
+	passthrough := newUpstreamSubnets([]*ecsPolicy{{mode: ecsPassthrough}})
+	o1 := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.IPv4(192, 0, 2, 0)}
+	o2 := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.IPv4(198, 51, 100, 0)}
+	require.Equal(t, key(passthrough, "10.2.1.1", o1), key(passthrough, "10.1.1.1", o1))
+	require.NotEqual(t, key(passthrough, "10.1.1.1", o2), key(passthrough, "10.1.1.1", o1))
+	require.NotEqual(t, key(passthrough, "10.1.1.1", nil), key(passthrough, "10.1.1.1", o1))
+
+	ctx1 := withClientIP(context.Background(), net.ParseIP("10.1.1.1"))
+	ctx2 := withClientIP(context.Background(), net.ParseIP("10.2.1.1"))
+	require.NotEqual(t, coalesceKey(req, subnets.subnets(ctx1, req)), coalesceKey(req, subnets.subnets(ctx2, req)))
+}
@@ -0,0 +1,61 @@
+package https
+
+import (
+	"github.com/miekg/dns"
+)
+
+// hasOption reports whether the message has the EDNS(0) option with the given code.
+func hasOption(m *dns.Msg, code uint16) bool {
+	return findOption(m, code) != nil
+}
+
+// findOption returns the EDNS(0) option of the message with the given code or nil if there is none.
+func findOption(m *dns.Msg, code uint16) dns.EDNS0 {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if o.Option() == code {
+			return o
+		}
+	}
+	return nil
+}
+
+// removeOption removes the EDNS(0) options with the given code from the OPT record.
+func removeOption(opt *dns.OPT, code uint16) {
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != code {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+}
+
+// stripResponseOptions removes the EDNS(0) options added to the upstream query from the response,
+// so that the client gets only the options it asked for. It removes the OPT record of the response
+// if the client request has no OPT record, and the Padding and Client Subnet options
+// if the client request has no such options.
+func stripResponseOptions(req, resp *dns.Msg) {
+	if req.IsEdns0() == nil {
+		extra := resp.Extra[:0]
+		for _, rr := range resp.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		resp.Extra = extra
+		return
+	}
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return
+	}
+	for _, code := range []uint16{dns.EDNS0PADDING, dns.EDNS0SUBNET} {
+		if !hasOption(req, code) {
+			removeOption(opt, code)
+		}
+	}
+}
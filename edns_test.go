@@ -0,0 +1,43 @@
+package https
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStripResponseOptions(t *testing.T) {
+	newResponse := func() *dns.Msg {
+		msg := newExpectedDNSMsg()
+		msg.SetEdns0(4096, false)
+		opt := msg.IsEdns0()
+		opt.Option = append(opt.Option,
+			&dns.EDNS0_NSID{Code: dns.EDNS0NSID},
+			&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.IPv4(10, 0, 0, 0)},
+			&dns.EDNS0_PADDING{Padding: make([]byte, 100)})
+		return msg
+	}
+
+	resp := newResponse()
+	stripResponseOptions(newRequestDNSMsg(), resp)
+	require.Nil(t, resp.IsEdns0(), "OPT record must be removed if the client request has no OPT record")
+	require.Len(t, resp.Answer, 1)
+
+	req := newRequestDNSMsg()
+	req.SetEdns0(4096, false)
+	resp = newResponse()
+	stripResponseOptions(req, resp)
+	require.NotNil(t, resp.IsEdns0())
+	require.False(t, hasOption(resp, dns.EDNS0PADDING))
+	require.False(t, hasOption(resp, dns.EDNS0SUBNET))
+	require.True(t, hasOption(resp, dns.EDNS0NSID))
+
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.IPv4(10, 0, 0, 0)})
+	resp = newResponse()
+	stripResponseOptions(req, resp)
+	require.False(t, hasOption(resp, dns.EDNS0PADDING))
+	require.True(t, hasOption(resp, dns.EDNS0SUBNET), "options asked by the client must be kept")
+}
@@ -0,0 +1,122 @@
+package https
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const defaultHealthCheckDomain = "."
+
+// upstreamHealth reports whether an upstream is considered down.
+type upstreamHealth interface {
+	Down() bool
+}
+
+// healthChecker periodically sends probe queries to an upstream and marks it up or down.
+// For health checks we send ". IN NS" message (or the configured domain) to the upstream.
+// Any error is considered a fail, basically anything else constitutes a healthy upstream.
+type healthChecker struct {
+	client   dnsClient
+	addr     string
+	domain   string
+	interval time.Duration
+	timeout  time.Duration
+
+	down uint32
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newHealthChecker(client dnsClient, addr string, interval time.Duration, opts ...healthCheckerOption) *healthChecker {
+	hc := &healthChecker{
+		client:   client,
+		addr:     addr,
+		domain:   defaultHealthCheckDomain,
+		interval: interval,
+		timeout:  defaultRequestTimeout,
+	}
+	// option pattern
+	for _, o := range opts {
+		o(hc)
+	}
+	return hc
+}
+
+type healthCheckerOption func(hc *healthChecker)
+
+func withHealthCheckDomain(domain string) healthCheckerOption {
+	return func(hc *healthChecker) {
+		hc.domain = domain
+	}
+}
+
+func withHealthCheckTimeout(timeout time.Duration) healthCheckerOption {
+	return func(hc *healthChecker) {
+		hc.timeout = timeout
+	}
+}
+
+// Down implements upstreamHealth.
+func (hc *healthChecker) Down() bool {
+	return atomic.LoadUint32(&hc.down) == 1
+}
+
+// Start starts the health checking goroutine.
+func (hc *healthChecker) Start() {
+	hc.stop = make(chan struct{})
+	hc.wg.Add(1)
+	go func() {
+		defer hc.wg.Done()
+		ticker := time.NewTicker(hc.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-hc.stop:
+				return
+			case <-ticker.C:
+				hc.check()
+			}
+		}
+	}()
+}
+
+// Stop stops the health checking goroutine and waits for it to exit.
+func (hc *healthChecker) Stop() {
+	if hc.stop == nil {
+		return
+	}
+	close(hc.stop)
+	hc.wg.Wait()
+}
+
+func (hc *healthChecker) check() {
+	var down uint32
+	if err := hc.probe(); err != nil {
+		down = 1
+	}
+	if prev := atomic.SwapUint32(&hc.down, down); prev != down {
+		if down == 1 {
+			log.Warningf("Upstream %s is down", hc.addr)
+		} else {
+			log.Infof("Upstream %s is up", hc.addr)
+		}
+	}
+}
+
+func (hc *healthChecker) probe() error {
+	msg := new(dns.Msg)
+	msg.SetQuestion(hc.domain, dns.TypeNS)
+	dnsreq, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hc.timeout)
+	defer cancel()
+	_, err = hc.client.Query(ctx, dnsreq)
+	return err
+}
@@ -0,0 +1,61 @@
+package https
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthCheckerCheck(t *testing.T) {
+	var clientErr error
+	callCount := 0
+	dnsClient := mockDNSClientFunc(func(ctx context.Context, dnsreq []byte) (*dns.Msg, error) {
+		callCount++
+		_, ok := ctx.Deadline()
+		require.True(t, ok, "probe query must have a deadline")
+
+		msg := new(dns.Msg)
+		require.NoError(t, msg.Unpack(dnsreq))
+		require.Equal(t, 1, len(msg.Question))
+		require.Equal(t, "example.org.", msg.Question[0].Name)
+		require.Equal(t, dns.TypeNS, msg.Question[0].Qtype)
+		return newExpectedDNSMsg(), clientErr
+	})
+	hc := newHealthChecker(dnsClient, upstreamURL, time.Second, withHealthCheckDomain("example.org."))
+	require.False(t, hc.Down(), "upstream must be up initially")
+
+	clientErr = errors.New("client error")
+	hc.check()
+	require.True(t, hc.Down())
+
+	clientErr = nil
+	hc.check()
+	require.False(t, hc.Down())
+	require.Equal(t, 2, callCount)
+}
+
+func TestHealthCheckerStartStop(t *testing.T) {
+	var callCount int32
+	dnsClient := mockDNSClientFunc(func(ctx context.Context, dnsreq []byte) (*dns.Msg, error) {
+		atomic.AddInt32(&callCount, 1)
+		return nil, errors.New("client error")
+	})
+	hc := newHealthChecker(dnsClient, upstreamURL, 10*time.Millisecond)
+	hc.Start()
+	require.Eventually(t, hc.Down, time.Second, 10*time.Millisecond)
+	hc.Stop()
+
+	count := atomic.LoadInt32(&callCount)
+	time.Sleep(30 * time.Millisecond)
+	require.Equal(t, count, atomic.LoadInt32(&callCount), "health checker must be stopped")
+}
+
+func TestHealthCheckerStopNotStarted(t *testing.T) {
+	hc := newHealthChecker(&mockDNSClient{t: t}, upstreamURL, time.Second)
+	hc.Stop()
+}
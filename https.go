@@ -5,30 +5,73 @@ package https
 
 import (
 	"context"
+	"net"
 
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/plugin/debug"
+	clog "github.com/coredns/coredns/plugin/pkg/log"
 	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
 )
 
+var log = clog.NewWithPlugin("https")
+
 // HTTPS represents a plugin instance that can proxy requests to another (DNS) server via DoH protocol.
 // It has a list of proxies each representing one upstream proxy
 type HTTPS struct {
-	from   string
-	except []string
-	client dnsClient
-	Next   plugin.Handler
+	from             string
+	fromList         *domainList
+	except           *domainList
+	client           dnsClient
+	views            []*clientView
+	ecs              *ecsPolicy
+	paddingBlockSize int
+	// fallthroughOnError is true if queries are passed to the next plugin on upstream errors
+	// and responses with fallthroughRcodes
+	fallthroughOnError bool
+	fallthroughRcodes  []int
+	Next               plugin.Handler
 }
 
 type httpsOption func(h *HTTPS)
 
-func withExcept(except []string) httpsOption {
+func withFromList(fromList *domainList) httpsOption {
+	return func(h *HTTPS) {
+		h.fromList = fromList
+	}
+}
+
+func withExcept(except *domainList) httpsOption {
 	return func(h *HTTPS) {
 		h.except = except
 	}
 }
 
+func withViews(views []*clientView) httpsOption {
+	return func(h *HTTPS) {
+		h.views = views
+	}
+}
+
+func withECS(ecs *ecsPolicy) httpsOption {
+	return func(h *HTTPS) {
+		h.ecs = ecs
+	}
+}
+
+func withPadding(blockSize int) httpsOption {
+	return func(h *HTTPS) {
+		h.paddingBlockSize = blockSize
+	}
+}
+
+func withFallthroughOnError(rcodes []int) httpsOption {
+	return func(h *HTTPS) {
+		h.fallthroughOnError = true
+		h.fallthroughRcodes = rcodes
+	}
+}
+
 // newHTTPS returns a new HTTPS.
 func newHTTPS(from string, client dnsClient, opts ...httpsOption) *HTTPS {
 	h := &HTTPS{from: from, client: client}
@@ -51,14 +94,29 @@ func (h *HTTPS) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg)
 		return plugin.NextOrFailure(h.Name(), h.Next, ctx, w, r)
 	}
 
-	dnsreq, err := r.Pack()
+	ip := net.ParseIP(state.IP())
+	req := h.upstreamRequest(r, ip)
+	dnsreq, err := req.Pack()
 	if err != nil {
 		return dns.RcodeServerFailure, err
 	}
-	result, err := h.client.Query(ctx, dnsreq)
+	clientSubnet, _ := findOption(r, dns.EDNS0SUBNET).(*dns.EDNS0_SUBNET)
+	queryCtx := withRequest(withClientSubnet(withClientIP(ctx, ip), clientSubnet), dnsreq, req)
+	result, err := h.viewClient(ip).Query(queryCtx, dnsreq)
 	if err != nil {
+		if h.fallthroughOnError {
+			log.Debugf("Passing %s %d to the next plugin after upstream error: %s", state.QName(), state.QType(), err)
+			return plugin.NextOrFailure(h.Name(), h.Next, ctx, w, r)
+		}
 		return dns.RcodeServerFailure, err
 	}
+	if h.isFallthroughRcode(result.Rcode) {
+		log.Debugf("Passing %s %d to the next plugin after upstream %s", state.QName(), state.QType(), dns.RcodeToString[result.Rcode])
+		return plugin.NextOrFailure(h.Name(), h.Next, ctx, w, r)
+	}
+	// the client must not get EDNS(0) options it didn't ask for,
+	// including the ones added by the upstreams with their own ECS policy
+	stripResponseOptions(r, result)
 
 	// Check if the reply is correct; if not return FormErr.
 	// maybe useful to extract this logic from forward, grpc and https plugins to common place
@@ -71,15 +129,56 @@ func (h *HTTPS) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg)
 		return
 	}
 
+	// DoH responses may be larger than the client's buffer, e.g. the EDNS buffer size of UDP requests,
+	// truncate the response and set the TC bit so that the client retries over TCP.
+	result = state.Scrub(result)
 	err = w.WriteMsg(result)
 	return
 }
 
+// isFallthroughRcode reports whether the query with the upstream response rcode is passed to the next plugin.
+func (h *HTTPS) isFallthroughRcode(rcode int) bool {
+	for _, rc := range h.fallthroughRcodes {
+		if rc == rcode {
+			return true
+		}
+	}
+	return false
+}
+
+// viewClient returns the client of the first view that matches the client address
+// or the default client if there is no such view.
+func (h *HTTPS) viewClient(ip net.IP) dnsClient {
+	for _, v := range h.views {
+		if v.match(ip) {
+			return v.client
+		}
+	}
+	return h.client
+}
+
+// upstreamRequest returns the request to send upstream with the Client Subnet option set according to the ECS
+// policy and EDNS(0) padding. The client request r is returned if it doesn't have to be modified.
+func (h *HTTPS) upstreamRequest(r *dns.Msg, ip net.IP) *dns.Msg {
+	req := r
+	if h.ecs != nil && h.ecs.mode != ecsPassthrough {
+		req = r.Copy()
+		h.ecs.apply(req, ip)
+	}
+	if h.paddingBlockSize > 0 {
+		req = padRequest(req, h.paddingBlockSize)
+	}
+	return req
+}
+
 // TODO extract this logic from forward, grpc and https plugins to common place
 func (h *HTTPS) match(state request.Request) bool {
 	if !plugin.Name(h.from).Matches(state.Name()) || !h.isAllowedDomain(state.Name()) {
 		return false
 	}
+	if h.fromList != nil && !h.fromList.Match(state.Name()) {
+		return false
+	}
 
 	return true
 }
@@ -89,10 +188,5 @@ func (h *HTTPS) isAllowedDomain(name string) bool {
 		return true
 	}
 
-	for _, ignore := range h.except {
-		if plugin.Name(ignore).Matches(name) {
-			return false
-		}
-	}
-	return true
+	return h.except == nil || !h.except.Match(name)
 }
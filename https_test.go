@@ -3,8 +3,10 @@ package https
 import (
 	"context"
 	"errors"
+	"net"
 	"testing"
 
+	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/plugin/pkg/dnstest"
 	"github.com/coredns/coredns/plugin/test"
 	"github.com/miekg/dns"
@@ -121,3 +123,135 @@ func TestHTTPSDNSResponseStateNotMatch(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, dns.RcodeFormatError, rec.Rcode)
 }
+
+func newLargeDNSMsg() *dns.Msg {
+	msg := newExpectedDNSMsg()
+	for i := 0; i < 100; i++ {
+		msg.Answer = append(msg.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 30},
+			A:   net.IPv4(10, 0, 0, byte(i)),
+		})
+	}
+	return msg
+}
+
+func TestHTTPSTruncateLargeResponse(t *testing.T) {
+	dnsClient := mockDNSClientFunc(func(_ context.Context, _ []byte) (*dns.Msg, error) {
+		return newLargeDNSMsg(), nil
+	})
+	h := newHTTPS(".", dnsClient)
+
+	t.Run("UDP", func(t *testing.T) {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		_, err := h.ServeDNS(context.Background(), rec, newRequestDNSMsg())
+		require.NoError(t, err)
+		require.True(t, rec.Msg.Truncated)
+		require.LessOrEqual(t, rec.Msg.Len(), dns.MinMsgSize)
+	})
+
+	t.Run("UDPWithEDNS", func(t *testing.T) {
+		req := newRequestDNSMsg()
+		req.SetEdns0(4096, false)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		_, err := h.ServeDNS(context.Background(), rec, req)
+		require.NoError(t, err)
+		require.False(t, rec.Msg.Truncated)
+		require.Len(t, rec.Msg.Answer, 101)
+	})
+
+	t.Run("TCP", func(t *testing.T) {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{TCP: true})
+		_, err := h.ServeDNS(context.Background(), rec, newRequestDNSMsg())
+		require.NoError(t, err)
+		require.False(t, rec.Msg.Truncated)
+		require.Len(t, rec.Msg.Answer, 101)
+	})
+}
+
+func TestHTTPSIsAllowedDomain(t *testing.T) {
+	except, err := newDomainList("except", []string{"example.org.", "*.internal.*.", `regex:^ads[0-9]*\.`}, nil, 0)
+	require.NoError(t, err)
+	h := newHTTPS(".", &mockDNSClient{t: t}, withExcept(except))
+
+	require.True(t, h.isAllowedDomain("."))
+	require.True(t, h.isAllowedDomain("example.com."))
+	require.False(t, h.isAllowedDomain("www.example.org."))
+	require.False(t, h.isAllowedDomain("printer.internal.corp."))
+	require.False(t, h.isAllowedDomain("ads42.example.com."))
+	require.True(t, newHTTPS(".", &mockDNSClient{t: t}).isAllowedDomain("www.example.org."))
+}
+
+func TestHTTPSFromList(t *testing.T) {
+	fromList, err := newDomainList("from", []string{"example.com."}, nil, 0)
+	require.NoError(t, err)
+	dnsClient := &mockDNSClient{t: t}
+	h := newHTTPS(".", dnsClient, withFromList(fromList))
+	next := test.NextHandler(dns.RcodeRefused, nil)
+	h.Next = next
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	status, err := h.ServeDNS(context.Background(), rec, req)
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, status)
+	require.Equal(t, 0, dnsClient.callCount)
+}
+
+func TestHTTPSFallthroughOnError(t *testing.T) {
+	dnsClient := mockDNSClientFunc(func(_ context.Context, _ []byte) (*dns.Msg, error) {
+		return nil, errors.New("dns client error")
+	})
+	h := newHTTPS(".", dnsClient, withFallthroughOnError(nil))
+	h.Next = test.NextHandler(dns.RcodeSuccess, nil)
+
+	status, err := h.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), newRequestDNSMsg())
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, status)
+}
+
+func TestHTTPSFallthroughOnErrorNoNext(t *testing.T) {
+	dnsClient := mockDNSClientFunc(func(_ context.Context, _ []byte) (*dns.Msg, error) {
+		return nil, errors.New("dns client error")
+	})
+	h := newHTTPS(".", dnsClient, withFallthroughOnError(nil))
+
+	status, err := h.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), newRequestDNSMsg())
+	require.Error(t, err)
+	require.Equal(t, dns.RcodeServerFailure, status)
+}
+
+func TestHTTPSFallthroughRcode(t *testing.T) {
+	tests := []struct {
+		name           string
+		rcode          int
+		expectedStatus int
+		expectedCalls  int
+	}{
+		{name: "ServFail", rcode: dns.RcodeServerFailure, expectedStatus: dns.RcodeRefused, expectedCalls: 1},
+		{name: "Refused", rcode: dns.RcodeRefused, expectedStatus: dns.RcodeRefused, expectedCalls: 1},
+		// the response is written by the plugin
+		{name: "NXDomain", rcode: dns.RcodeNameError, expectedStatus: dns.RcodeSuccess, expectedCalls: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dnsClient := mockDNSClientFunc(func(_ context.Context, dnsreq []byte) (*dns.Msg, error) {
+				req := new(dns.Msg)
+				require.NoError(t, req.Unpack(dnsreq))
+				resp := new(dns.Msg)
+				resp.SetRcode(req, tt.rcode)
+				return resp, nil
+			})
+			h := newHTTPS(".", dnsClient, withFallthroughOnError([]int{dns.RcodeServerFailure, dns.RcodeRefused}))
+			var nextCalls int
+			h.Next = plugin.HandlerFunc(func(_ context.Context, _ dns.ResponseWriter, _ *dns.Msg) (int, error) {
+				nextCalls++
+				return dns.RcodeRefused, nil
+			})
+			status, err := h.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), newRequestDNSMsg())
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedStatus, status)
+			require.Equal(t, tt.expectedCalls, nextCalls)
+		})
+	}
+}
@@ -28,4 +28,82 @@ var (
 		Buckets:   plugin.TimeBuckets,
 		Help:      "Histogram of the time each request took.",
 	}, []string{"to"})
+	HedgeCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "https",
+		Name:      "hedged_requests_total",
+		Help:      "Counter of hedged requests sent to the next upstream after the hedge delay.",
+	})
+	HedgeWinCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "https",
+		Name:      "hedge_wins_total",
+		Help:      "Counter of queries answered by a hedged request.",
+	})
+	RaceWinCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "https",
+		Name:      "race_wins_total",
+		Help:      "Counter of raced queries answered first per upstream.",
+	}, []string{"to"})
+	BreakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "https",
+		Name:      "circuit_breaker_state",
+		Help:      "Gauge of the circuit breaker state per upstream: 0 - closed, 1 - open, 2 - half-open.",
+	}, []string{"to"})
+	RouteCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "https",
+		Name:      "route_queries_total",
+		Help:      "Counter of queries sent to the upstreams of the route.",
+	}, []string{"route"})
+	CacheHitCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "https",
+		Name:      "cache_hits_total",
+		Help:      "Counter of queries answered from the cache.",
+	})
+	CacheMissCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "https",
+		Name:      "cache_misses_total",
+		Help:      "Counter of queries not found in the cache.",
+	})
+	CacheStaleCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "https",
+		Name:      "cache_served_stale_total",
+		Help:      "Counter of queries answered with stale responses from the cache.",
+	})
+	CachePrefetchCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "https",
+		Name:      "cache_prefetch_total",
+		Help:      "Counter of cache entries refreshed in advance before expiry.",
+	})
+	CoalesceQueryCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "https",
+		Name:      "coalesce_queries_total",
+		Help:      "Counter of queries sent to upstreams or coalesced with identical in-flight queries.",
+	})
+	CoalesceSharedCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "https",
+		Name:      "coalesce_shared_total",
+		Help:      "Counter of queries answered by identical in-flight queries.",
+	})
+	DomainListReloadCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "https",
+		Name:      "domain_list_reloads_total",
+		Help:      "Counter of successful reloads of the domain list files per list.",
+	}, []string{"list"})
+	DomainListReloadFailCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "https",
+		Name:      "domain_list_reload_failures_total",
+		Help:      "Counter of failed reloads of the domain list files per list.",
+	}, []string{"list"})
 )
@@ -0,0 +1,28 @@
+package https
+
+import (
+	"github.com/miekg/dns"
+)
+
+// RFC8467 Section 4.1:
+// Clients SHOULD pad queries to the closest multiple of 128 octets.
+const defaultPaddingBlockSize = 128
+
+// padRequest returns a copy of the request with the EDNS(0) Padding option (RFC 7830)
+// that makes the size of the packed request a multiple of blockSize (RFC 8467 Section 4.1).
+// The request gets an OPT record if it doesn't have one.
+func padRequest(r *dns.Msg, blockSize int) *dns.Msg {
+	req := r.Copy()
+	opt := req.IsEdns0()
+	if opt == nil {
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		opt = req.IsEdns0()
+	}
+	removeOption(opt, dns.EDNS0PADDING)
+	padding := &dns.EDNS0_PADDING{}
+	opt.Option = append(opt.Option, padding)
+	if n := req.Len() % blockSize; n != 0 {
+		padding.Padding = make([]byte, blockSize-n)
+	}
+	return req
+}
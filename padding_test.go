@@ -0,0 +1,110 @@
+package https
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPadRequest(t *testing.T) {
+	tests := []struct {
+		name      string
+		blockSize int
+		newMsg    func() *dns.Msg
+	}{
+		{
+			name:      "WithoutOPT",
+			blockSize: 128,
+			newMsg:    newRequestDNSMsg,
+		},
+		{
+			name:      "WithOPT",
+			blockSize: 128,
+			newMsg: func() *dns.Msg {
+				msg := newRequestDNSMsg()
+				msg.SetEdns0(4096, true)
+				return msg
+			},
+		},
+		{
+			name:      "WithClientPadding",
+			blockSize: 468,
+			newMsg: func() *dns.Msg {
+				msg := newRequestDNSMsg()
+				msg.SetEdns0(4096, true)
+				opt := msg.IsEdns0()
+				opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, 10)})
+				return msg
+			},
+		},
+		{
+			name:      "LongName",
+			blockSize: 128,
+			newMsg: func() *dns.Msg {
+				msg := new(dns.Msg)
+				msg.SetQuestion("very-very-long-subdomain-name-to-make-the-query-longer.sub.example.com.", dns.TypeA)
+				msg.SetEdns0(4096, false)
+				return msg
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := tt.newMsg()
+			orig := packMsg(t, msg)
+			req := padRequest(msg, tt.blockSize)
+			require.Equal(t, orig, packMsg(t, msg), "the original request must not be modified")
+
+			data := packMsg(t, req)
+			require.Zero(t, len(data)%tt.blockSize, "padded request size %d", len(data))
+			require.True(t, hasOption(req, dns.EDNS0PADDING))
+
+			paddings := 0
+			for _, o := range req.IsEdns0().Option {
+				if o.Option() == dns.EDNS0PADDING {
+					paddings++
+				}
+			}
+			require.Equal(t, 1, paddings)
+		})
+	}
+}
+
+func TestHTTPSPadding(t *testing.T) {
+	var upstreamReq *dns.Msg
+	dnsClient := mockDNSClientFunc(func(_ context.Context, dnsreq []byte) (*dns.Msg, error) {
+		require.Zero(t, len(dnsreq)%128)
+		upstreamReq = new(dns.Msg)
+		require.NoError(t, upstreamReq.Unpack(dnsreq))
+		resp := newExpectedDNSMsg()
+		resp.Id = upstreamReq.Id
+		resp.SetEdns0(4096, false)
+		opt := resp.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, 100)})
+		return resp, nil
+	})
+	h := newHTTPS(".", dnsClient, withPadding(128))
+
+	t.Run("ClientWithoutPadding", func(t *testing.T) {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		_, err := h.ServeDNS(context.Background(), rec, newRequestDNSMsg())
+		require.NoError(t, err)
+		require.True(t, hasOption(upstreamReq, dns.EDNS0PADDING))
+		require.Nil(t, rec.Msg.IsEdns0())
+	})
+
+	t.Run("ClientWithPadding", func(t *testing.T) {
+		req := newRequestDNSMsg()
+		req.SetEdns0(4096, false)
+		opt := req.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, 10)})
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		_, err := h.ServeDNS(context.Background(), rec, req)
+		require.NoError(t, err)
+		require.True(t, hasOption(rec.Msg, dns.EDNS0PADDING))
+	})
+}
@@ -1,14 +1,29 @@
 package https
 
 import (
+	"hash/fnv"
 	"math"
 	"math/rand"
+	"sort"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
 )
 
 // policy defines a policy we use for selecting upstreams.
+// List returns the order in which upstreams are tried for the packed DNS request dnsreq.
 type policy interface {
-	List(poolLen int) []int
+	List(poolLen int, dnsreq []byte) []int
+}
+
+// feedbackPolicy is a policy that is notified when a request to an upstream starts and finishes.
+type feedbackPolicy interface {
+	policy
+	Start(id int)
+	Finish(id int)
 }
 
 // randomPolicy is a policy that implements random upstream selection.
@@ -18,7 +33,7 @@ func newRandomPolicy() *randomPolicy {
 	return &randomPolicy{}
 }
 
-func (*randomPolicy) List(poolLen int) []int {
+func (*randomPolicy) List(poolLen int, _ []byte) []int {
 	if poolLen <= 0 {
 		return nil
 	}
@@ -34,7 +49,7 @@ func newRoundRobinPolicy() *roundRobinPolicy {
 	return &roundRobinPolicy{robin: math.MaxUint32}
 }
 
-func (p *roundRobinPolicy) List(poolLen int) (result []int) {
+func (p *roundRobinPolicy) List(poolLen int, _ []byte) (result []int) {
 	if poolLen <= 0 {
 		return
 	}
@@ -56,7 +71,7 @@ func newSequentialPolicy() *sequentialPolicy {
 	return &sequentialPolicy{}
 }
 
-func (*sequentialPolicy) List(poolLen int) (result []int) {
+func (*sequentialPolicy) List(poolLen int, _ []byte) (result []int) {
 	if poolLen <= 0 {
 		return
 	}
@@ -66,3 +81,265 @@ func (*sequentialPolicy) List(poolLen int) (result []int) {
 	}
 	return
 }
+
+const (
+	// smoothing factor of the exponentially weighted moving average of upstream latencies
+	fastestPolicyAlpha = 0.3
+	// probability of trying a random upstream first to re-measure its latency
+	fastestPolicyExploreRate = 0.05
+)
+
+// latencyObserver is implemented by policies that need upstream latencies.
+type latencyObserver interface {
+	Observe(id int, d time.Duration)
+}
+
+// fastestPolicy is a policy that selects hosts ordered by the exponentially weighted moving average
+// of their latencies. Upstreams that have not been measured yet are selected first, and with a small
+// probability a random upstream is selected first so that the latency of slow upstreams is re-measured.
+type fastestPolicy struct {
+	exploreRate float64
+
+	mu      sync.RWMutex
+	latency []float64
+}
+
+func newFastestPolicy() *fastestPolicy {
+	return &fastestPolicy{exploreRate: fastestPolicyExploreRate}
+}
+
+func (p *fastestPolicy) List(poolLen int, _ []byte) (result []int) {
+	if poolLen <= 0 {
+		return
+	}
+	latency := make([]float64, poolLen)
+	p.mu.RLock()
+	copy(latency, p.latency)
+	p.mu.RUnlock()
+
+	result = make([]int, poolLen)
+	for i := 0; i < poolLen; i++ {
+		result[i] = i
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return latency[result[i]] < latency[result[j]]
+	})
+
+	if poolLen > 1 && rand.Float64() < p.exploreRate {
+		// move a random upstream to the front
+		i := 1 + rand.Intn(poolLen-1)
+		id := result[i]
+		copy(result[1:i+1], result[:i])
+		result[0] = id
+	}
+	return
+}
+
+// Observe implements latencyObserver.
+func (p *fastestPolicy) Observe(id int, d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if id >= len(p.latency) {
+		latency := make([]float64, id+1)
+		copy(latency, p.latency)
+		p.latency = latency
+	}
+	if p.latency[id] == 0 {
+		p.latency[id] = float64(d)
+		return
+	}
+	p.latency[id] = fastestPolicyAlpha*float64(d) + (1-fastestPolicyAlpha)*p.latency[id]
+}
+
+// p2cPolicy is a policy that implements the power of two random choices upstream selection:
+// the less loaded of two random upstreams is selected first, the load of an upstream is the number
+// of its in-flight requests.
+type p2cPolicy struct {
+	inflight [maxUpstreams]int64
+}
+
+func newP2CPolicy() *p2cPolicy {
+	return &p2cPolicy{}
+}
+
+func (p *p2cPolicy) List(poolLen int, _ []byte) []int {
+	if poolLen <= 0 {
+		return nil
+	}
+	result := rand.Perm(poolLen)
+	if poolLen > 1 && p.load(result[1]) < p.load(result[0]) {
+		result[0], result[1] = result[1], result[0]
+	}
+	return result
+}
+
+// Start implements feedbackPolicy.
+func (p *p2cPolicy) Start(id int) {
+	atomic.AddInt64(&p.inflight[id], 1)
+}
+
+// Finish implements feedbackPolicy.
+func (p *p2cPolicy) Finish(id int) {
+	atomic.AddInt64(&p.inflight[id], -1)
+}
+
+func (p *p2cPolicy) load(id int) int64 {
+	return atomic.LoadInt64(&p.inflight[id])
+}
+
+// weightedRandomPolicy is a policy that implements weighted random upstream selection:
+// upstreams are ordered randomly, upstreams with larger weights are more likely to be at the beginning.
+type weightedRandomPolicy struct {
+	weights []int
+}
+
+// newWeightedRandomPolicy creates a new weighted random policy,
+// upstreams without weights have the weight of 1.
+func newWeightedRandomPolicy(weights []int) *weightedRandomPolicy {
+	return &weightedRandomPolicy{weights: weights}
+}
+
+func (p *weightedRandomPolicy) List(poolLen int, _ []byte) []int {
+	if poolLen <= 0 {
+		return nil
+	}
+	// weighted random sampling without replacement (Efraimidis-Spirakis):
+	// order by rand^(1/weight) descending.
+	keys := make([]float64, poolLen)
+	result := make([]int, poolLen)
+	for i := 0; i < poolLen; i++ {
+		keys[i] = math.Pow(rand.Float64(), 1/float64(upstreamWeight(p.weights, i)))
+		result[i] = i
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return keys[result[i]] > keys[result[j]]
+	})
+	return result
+}
+
+// weightedRoundRobinPolicy is a policy that selects hosts based on smooth weighted round robin ordering:
+// each upstream is selected first proportionally to its weight, the selections are evenly interleaved.
+type weightedRoundRobinPolicy struct {
+	weights []int
+
+	mu      sync.Mutex
+	current []int
+}
+
+// newWeightedRoundRobinPolicy creates a new weighted round robin policy,
+// upstreams without weights have the weight of 1.
+func newWeightedRoundRobinPolicy(weights []int) *weightedRoundRobinPolicy {
+	return &weightedRoundRobinPolicy{weights: weights}
+}
+
+func (p *weightedRoundRobinPolicy) List(poolLen int, _ []byte) (result []int) {
+	if poolLen <= 0 {
+		return
+	}
+	i := p.next(poolLen)
+	result = make([]int, 0, poolLen)
+	for j := i; j < poolLen; j++ {
+		result = append(result, j)
+	}
+	for j := 0; j < i; j++ {
+		result = append(result, j)
+	}
+	return
+}
+
+// next returns the next upstream selected by nginx smooth weighted round robin algorithm.
+func (p *weightedRoundRobinPolicy) next(poolLen int) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.current) != poolLen {
+		p.current = make([]int, poolLen)
+	}
+	best, total := 0, 0
+	for i := 0; i < poolLen; i++ {
+		weight := upstreamWeight(p.weights, i)
+		p.current[i] += weight
+		total += weight
+		if p.current[i] > p.current[best] {
+			best = i
+		}
+	}
+	p.current[best] -= total
+	return best
+}
+
+func upstreamWeight(weights []int, id int) int {
+	if id < len(weights) {
+		return weights[id]
+	}
+	return defaultUpstreamWeight
+}
+
+// hashQnamePolicy is a policy that selects hosts based on rendezvous hashing of the query name:
+// the same query name is always sent to the same upstream first. When an upstream is removed
+// or is down, only the names of this upstream are moved to other upstreams.
+type hashQnamePolicy struct {
+	// hashes of upstream addresses, so that the order does not depend on upstream positions
+	keys []uint64
+}
+
+// newHashQnamePolicy creates a new rendezvous hashing policy for upstreams with the given addresses.
+func newHashQnamePolicy(addrs []string) *hashQnamePolicy {
+	keys := make([]uint64, len(addrs))
+	for i, addr := range addrs {
+		keys[i] = hashString(addr)
+	}
+	return &hashQnamePolicy{keys: keys}
+}
+
+func (p *hashQnamePolicy) List(poolLen int, dnsreq []byte) []int {
+	if poolLen <= 0 {
+		return nil
+	}
+	qhash := hashString(strings.ToLower(qnameFromRequest(dnsreq)))
+	scores := make([]uint64, poolLen)
+	result := make([]int, poolLen)
+	for i := 0; i < poolLen; i++ {
+		key := uint64(i)
+		if i < len(p.keys) {
+			key = p.keys[i]
+		}
+		scores[i] = mix64(qhash ^ key)
+		result[i] = i
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return scores[result[i]] > scores[result[j]]
+	})
+	return result
+}
+
+// qnameFromRequest returns the name of the first question of the packed DNS request
+// without unpacking the whole message.
+func qnameFromRequest(dnsreq []byte) string {
+	// the question section starts right after the 12-byte header
+	const headerLen = 12
+	if len(dnsreq) <= headerLen {
+		return ""
+	}
+	name, _, err := dns.UnpackDomainName(dnsreq, headerLen)
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// mix64 is the splitmix64 finalizer, it spreads the bits of the combined hash
+// so that the scores of different upstreams are independent.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
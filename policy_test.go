@@ -1,7 +1,11 @@
 package https
 
 import (
+	"fmt"
 	"testing"
+	"time"
+
+	"github.com/miekg/dns"
 
 	"github.com/stretchr/testify/require"
 )
@@ -49,11 +53,11 @@ func TestRandomPolicy(t *testing.T) {
 			r := newRandomPolicy()
 			if tt.poolLen < 2 {
 				for i, expected := range tt.expected {
-					result := r.List(len(expected))
+					result := r.List(len(expected), nil)
 					require.Equal(t, expected, result, "iteration %d", i)
 				}
 			} else {
-				result := r.List(tt.poolLen)
+				result := r.List(tt.poolLen, nil)
 				require.Equal(t, tt.poolLen, len(result))
 				// verify all elements
 				visited := make([]bool, tt.poolLen)
@@ -120,7 +124,7 @@ func TestRoundRobinPolicy(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			r := newRoundRobinPolicy()
 			for i, expected := range tt.expected {
-				result := r.List(len(expected))
+				result := r.List(len(expected), nil)
 				require.Equal(t, expected, result, "iteration %d", i)
 			}
 		})
@@ -177,9 +181,173 @@ func TestSequentialPolicy(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			p := newSequentialPolicy()
 			for i, expected := range tt.expected {
-				result := p.List(len(expected))
+				result := p.List(len(expected), nil)
 				require.Equal(t, expected, result, "iteration %d", i)
 			}
 		})
 	}
 }
+
+func TestFastestPolicy(t *testing.T) {
+	p := newFastestPolicy()
+	p.exploreRate = 0
+
+	require.Nil(t, p.List(0, nil))
+	require.Equal(t, []int{0, 1, 2}, p.List(3, nil), "unmeasured upstreams must keep sequential order")
+
+	p.Observe(0, 30*time.Millisecond)
+	p.Observe(1, 10*time.Millisecond)
+	require.Equal(t, []int{2, 1, 0}, p.List(3, nil), "unmeasured upstreams must be selected first")
+
+	p.Observe(2, 20*time.Millisecond)
+	require.Equal(t, []int{1, 2, 0}, p.List(3, nil))
+
+	// moving average must follow the latency change
+	for i := 0; i < 10; i++ {
+		p.Observe(1, 50*time.Millisecond)
+	}
+	require.Equal(t, []int{2, 0, 1}, p.List(3, nil))
+}
+
+func TestFastestPolicyExplore(t *testing.T) {
+	p := newFastestPolicy()
+	p.exploreRate = 1
+	p.Observe(0, 10*time.Millisecond)
+	p.Observe(1, 20*time.Millisecond)
+	p.Observe(2, 30*time.Millisecond)
+
+	for i := 0; i < 10; i++ {
+		result := p.List(3, nil)
+		require.NotEqual(t, 0, result[0], "slower upstream must be selected first, iteration %d", i)
+		require.ElementsMatch(t, []int{0, 1, 2}, result)
+		if result[0] == 1 {
+			require.Equal(t, []int{1, 0, 2}, result)
+		} else {
+			require.Equal(t, []int{2, 0, 1}, result)
+		}
+	}
+}
+
+func TestP2CPolicy(t *testing.T) {
+	p := newP2CPolicy()
+	require.Nil(t, p.List(0, nil))
+	require.Equal(t, []int{0}, p.List(1, nil))
+
+	// upstream 0 is always more loaded than upstream 1
+	p.Start(0)
+	for i := 0; i < 20; i++ {
+		result := p.List(2, nil)
+		require.Equal(t, []int{1, 0}, result, "iteration %d", i)
+	}
+	p.Finish(0)
+	require.Equal(t, int64(0), p.load(0))
+
+	// the most loaded upstream is never selected first
+	for i := 0; i < 5; i++ {
+		p.Start(2)
+	}
+	for i := 0; i < 50; i++ {
+		result := p.List(3, nil)
+		require.NotEqual(t, 2, result[0], "iteration %d", i)
+		require.ElementsMatch(t, []int{0, 1, 2}, result)
+	}
+}
+
+func TestWeightedRandomPolicy(t *testing.T) {
+	p := newWeightedRandomPolicy([]int{4, 1})
+	require.Nil(t, p.List(0, nil))
+	require.Equal(t, []int{0}, p.List(1, nil))
+
+	const iterations = 20000
+	firstCount := make([]int, 3)
+	for i := 0; i < iterations; i++ {
+		result := p.List(3, nil)
+		require.ElementsMatch(t, []int{0, 1, 2}, result)
+		firstCount[result[0]]++
+	}
+	// weights are 4, 1 and 1 (by default)
+	require.InDelta(t, 4.0/6, float64(firstCount[0])/iterations, 0.02)
+	require.InDelta(t, 1.0/6, float64(firstCount[1])/iterations, 0.02)
+	require.InDelta(t, 1.0/6, float64(firstCount[2])/iterations, 0.02)
+}
+
+func TestWeightedRoundRobinPolicy(t *testing.T) {
+	p := newWeightedRoundRobinPolicy([]int{4, 1})
+	require.Nil(t, p.List(0, nil))
+
+	expected := [][]int{{0, 1}, {0, 1}, {1, 0}, {0, 1}, {0, 1}}
+	for i := 0; i < 2; i++ {
+		for j, e := range expected {
+			require.Equal(t, e, p.List(2, nil), "iteration %d", i*len(expected)+j)
+		}
+	}
+}
+
+func TestWeightedRoundRobinPolicyDistribution(t *testing.T) {
+	p := newWeightedRoundRobinPolicy([]int{5, 3, 2})
+
+	const iterations = 1000
+	firstCount := make([]int, 3)
+	for i := 0; i < iterations; i++ {
+		result := p.List(3, nil)
+		require.ElementsMatch(t, []int{0, 1, 2}, result)
+		firstCount[result[0]]++
+	}
+	require.Equal(t, []int{500, 300, 200}, firstCount)
+}
+
+func packQuestion(t *testing.T, name string) []byte {
+	t.Helper()
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, dns.TypeA)
+	data, err := msg.Pack()
+	require.NoError(t, err)
+	return data
+}
+
+func TestHashQnamePolicy(t *testing.T) {
+	p := newHashQnamePolicy([]string{"a", "b", "c"})
+	require.Nil(t, p.List(0, nil))
+	require.Equal(t, []int{0}, p.List(1, packQuestion(t, "example.com.")))
+
+	result := p.List(3, packQuestion(t, "example.com."))
+	require.ElementsMatch(t, []int{0, 1, 2}, result)
+	for i := 0; i < 10; i++ {
+		require.Equal(t, result, p.List(3, packQuestion(t, "example.com.")), "iteration %d", i)
+	}
+	require.Equal(t, result, p.List(3, packQuestion(t, "EXAMPLE.com.")), "query name must be case insensitive")
+}
+
+func TestHashQnamePolicyDistribution(t *testing.T) {
+	p := newHashQnamePolicy([]string{"a", "b", "c"})
+
+	const names = 3000
+	firstCount := make([]int, 3)
+	for i := 0; i < names; i++ {
+		result := p.List(3, packQuestion(t, fmt.Sprintf("name%d.example.com.", i)))
+		firstCount[result[0]]++
+	}
+	for i, count := range firstCount {
+		require.InDelta(t, names/3, count, names/3*0.1, "upstream %d", i)
+	}
+}
+
+func TestHashQnamePolicyRemoveUpstream(t *testing.T) {
+	p := newHashQnamePolicy([]string{"a", "b", "c"})
+	// upstream "b" is removed
+	p2 := newHashQnamePolicy([]string{"a", "c"})
+	ids2 := []string{"a", "c"}
+	ids := []string{"a", "b", "c"}
+
+	for i := 0; i < 1000; i++ {
+		dnsreq := packQuestion(t, fmt.Sprintf("name%d.example.com.", i))
+		result := p.List(3, dnsreq)
+		result2 := p2.List(2, dnsreq)
+		if ids[result[0]] != "b" {
+			require.Equal(t, ids[result[0]], ids2[result2[0]], "name %d must not be moved", i)
+		} else {
+			// the name is moved to the next upstream in the list
+			require.Equal(t, ids[result[1]], ids2[result2[0]], "name %d must be moved to the next upstream", i)
+		}
+	}
+}
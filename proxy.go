@@ -3,10 +3,13 @@ package https
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"io"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/miekg/dns"
@@ -15,11 +18,14 @@ import (
 const (
 	dnsMessageMimeType = "application/dns-message"
 
-	// typical Ethernet MTU (1500 bytes) - min IP header size (20 bytes) - UDP header (8 bytes).
-	// It seems like a reasonable limitation for DoH protocol.
-	// However, if you know RFCs that specify this limit, update it.
-	maxDNSMessageSize     = 1472
-	defaultRequestTimeout = 2 * time.Second
+	// DoH runs over TCP, so DNS messages are limited only by the 2-byte length field
+	// of DNS over TCP (RFC 1035 Section 4.2.2).
+	defaultMaxDNSMessageSize = dns.MaxMsgSize
+	defaultRequestTimeout    = 2 * time.Second
+
+	// many HTTP servers and proxies limit the request line to 2-8 KiB,
+	// so it is safer to switch to POST for larger requests.
+	defaultMaxGetURLLength = 2048
 )
 
 var (
@@ -27,6 +33,7 @@ var (
 
 	errResponseTooLarge = errors.New("dns response size is too large")
 	errResponseStatus   = errors.New("invalid http response status code")
+	errMalformedRequest = errors.New("dns request must have exactly one question")
 )
 
 // dnsClient is the client API for DNS service
@@ -34,10 +41,54 @@ type dnsClient interface {
 	Query(ctx context.Context, dnsreq []byte) (result *dns.Msg, err error)
 }
 
+type requestKey struct{}
+
+// parsedRequest is the packed request and its message.
+type parsedRequest struct {
+	data []byte
+	msg  *dns.Msg
+}
+
+// withRequest returns a copy of ctx with the message of the packed request dnsreq,
+// so that the clients of the chain don't unpack the same request again, see unpackRequest.
+func withRequest(ctx context.Context, dnsreq []byte, req *dns.Msg) context.Context {
+	return context.WithValue(ctx, requestKey{}, &parsedRequest{data: dnsreq, msg: req})
+}
+
+// unpackRequest returns the message of the request dnsreq stored in ctx or unpacks it if dnsreq is another
+// request, for instance, the one rewritten by a client of the chain. The returned message must not be modified.
+// Clients pass the requests that fail to unpack or don't have exactly one question to the underlying client
+// as is and let the upstream deal with malformed requests.
+func unpackRequest(ctx context.Context, dnsreq []byte) (*dns.Msg, error) {
+	if p, ok := ctx.Value(requestKey{}).(*parsedRequest); ok &&
+		len(p.data) == len(dnsreq) && len(dnsreq) > 0 && &p.data[0] == &dnsreq[0] {
+		return p.msg, nil
+	}
+	req := new(dns.Msg)
+	if err := req.Unpack(dnsreq); err != nil {
+		return nil, err
+	}
+	if len(req.Question) != 1 {
+		return nil, errMalformedRequest
+	}
+	return req, nil
+}
+
 // newDoHDNSClient creates a new instance of dohDNSClient service.
 // url must be a full URL to send DoH requests to like "https://example.com/dns-query"
-func newDoHDNSClient(client httpRequestDoer, url string) *dohDNSClient {
-	return &dohDNSClient{client, url}
+func newDoHDNSClient(client httpRequestDoer, url string, opts ...dohDNSClientOption) *dohDNSClient {
+	c := &dohDNSClient{
+		client:       client,
+		url:          url,
+		method:       http.MethodPost,
+		maxGetURLLen: defaultMaxGetURLLength,
+		maxMsgSize:   defaultMaxDNSMessageSize,
+	}
+	// option pattern
+	for _, o := range opts {
+		o(c)
+	}
+	return c
 }
 
 type httpRequestDoer interface {
@@ -46,18 +97,89 @@ type httpRequestDoer interface {
 
 // dohDNSClient is a DNS client that proxies requests to the upstream server using DoH protocol.
 type dohDNSClient struct {
-	client httpRequestDoer
-	url    string
+	client       httpRequestDoer
+	url          string
+	method       string
+	maxGetURLLen int
+	maxMsgSize   int
+}
+
+type dohDNSClientOption func(c *dohDNSClient)
+
+// withDoHMethod sets the HTTP method used to send DNS requests, either GET or POST.
+func withDoHMethod(method string) dohDNSClientOption {
+	return func(c *dohDNSClient) {
+		c.method = method
+	}
+}
+
+// withDoHMaxGetURLLength sets the maximum length of the GET request URL,
+// longer requests are sent with POST method.
+func withDoHMaxGetURLLength(maxLen int) dohDNSClientOption {
+	return func(c *dohDNSClient) {
+		c.maxGetURLLen = maxLen
+	}
+}
+
+// withDoHMaxMessageSize sets the maximum size of DNS responses, larger responses are rejected.
+func withDoHMaxMessageSize(size int) dohDNSClientOption {
+	return func(c *dohDNSClient) {
+		c.maxMsgSize = size
+	}
 }
 
 func (c *dohDNSClient) Query(ctx context.Context, dnsreq []byte) (r *dns.Msg, err error) {
 	var req *http.Request
-	if req, err = http.NewRequestWithContext(ctx, "POST", c.url, bytes.NewReader(dnsreq)); err != nil {
-		return
+	var id uint16
+	restoreID := false
+	if getURL, ok := c.getURL(dnsreq); ok {
+		if req, err = http.NewRequestWithContext(ctx, http.MethodGet, getURL, http.NoBody); err != nil {
+			return
+		}
+		id, restoreID = binary.BigEndian.Uint16(dnsreq), true
+	} else {
+		if req, err = http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(dnsreq)); err != nil {
+			return
+		}
+		req.Header["Content-Type"] = dnsMessageMimeTypeHeader
 	}
 	req.Header["Accept"] = dnsMessageMimeTypeHeader
-	req.Header["Content-Type"] = dnsMessageMimeTypeHeader
 
+	if r, err = c.do(req); err != nil {
+		return
+	}
+	if restoreID {
+		r.Id = id
+	}
+	return
+}
+
+// getURL returns the URL of GET request with the base64url-encoded DNS message.
+// It returns false if the request must be sent with POST method.
+func (c *dohDNSClient) getURL(dnsreq []byte) (string, bool) {
+	if c.method != http.MethodGet || len(dnsreq) < 2 {
+		return "", false
+	}
+	// RFC8484 Section 4.1:
+	// In order to maximize HTTP cache friendliness, DoH clients using media
+	// formats that include the ID field from the DNS message header, such
+	// as "application/dns-message", SHOULD use a DNS ID of 0 in every DNS request.
+	msg := make([]byte, len(dnsreq))
+	copy(msg, dnsreq)
+	binary.BigEndian.PutUint16(msg, 0)
+
+	sep := "?"
+	if strings.Contains(c.url, "?") {
+		sep = "&"
+	}
+	getURL := c.url + sep + "dns=" + base64.RawURLEncoding.EncodeToString(msg)
+	if len(getURL) > c.maxGetURLLen {
+		return "", false
+	}
+	return getURL, true
+}
+
+func (c *dohDNSClient) do(req *http.Request) (r *dns.Msg, err error) {
 	var resp *http.Response
 	if resp, err = c.client.Do(req); err != nil {
 		return
@@ -76,31 +198,122 @@ func (c *dohDNSClient) Query(ctx context.Context, dnsreq []byte) (r *dns.Msg, er
 	// limit the number of bytes read to avoid potential DoS attacks.
 	// it would be better to add (*dns.Msg) Unpack(io.Reader) method to avoid byte slice allocation
 	var body []byte
-	if body, err = io.ReadAll(io.LimitReader(resp.Body, maxDNSMessageSize+1)); err != nil {
+	if body, err = io.ReadAll(io.LimitReader(resp.Body, int64(c.maxMsgSize)+1)); err != nil {
 		return
 	}
-	if len(body) > maxDNSMessageSize {
+	if len(body) > c.maxMsgSize {
 		return nil, errResponseTooLarge
 	}
 	r = new(dns.Msg)
-	err = r.Unpack(body)
+	if err = r.Unpack(body); err != nil {
+		return
+	}
+	adjustTTL(r, resp.Header)
 	return
 }
 
+// adjustTTL decreases the TTLs of the response records by the age of the HTTP response
+// and caps them at the remaining HTTP freshness lifetime.
+//
+// RFC8484 Section 5.1:
+// DoH clients MUST account for the Age response header field's value
+// when calculating the DNS TTL of a response.
+func adjustTTL(r *dns.Msg, header http.Header) {
+	age := httpAge(header)
+	maxAge, hasMaxAge := httpMaxAge(header)
+	if age == 0 && !hasMaxAge {
+		return
+	}
+	limit := uint32(0)
+	if hasMaxAge && maxAge > age {
+		limit = maxAge - age
+	}
+	adjust := func(rrs []dns.RR) {
+		for _, rr := range rrs {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				// OPT records use TTL field for extended rcode and flags
+				continue
+			}
+			if hdr.Ttl > age {
+				hdr.Ttl -= age
+			} else {
+				hdr.Ttl = 0
+			}
+			if hasMaxAge && hdr.Ttl > limit {
+				hdr.Ttl = limit
+			}
+		}
+	}
+	adjust(r.Answer)
+	adjust(r.Ns)
+	adjust(r.Extra)
+}
+
+// httpAge returns the value of the Age header in seconds.
+func httpAge(header http.Header) uint32 {
+	age, err := strconv.ParseUint(strings.TrimSpace(header.Get("Age")), 10, 32)
+	if err != nil {
+		return 0
+	}
+	return uint32(age)
+}
+
+// httpMaxAge returns the value of the max-age directive of the Cache-Control header in seconds.
+func httpMaxAge(header http.Header) (uint32, bool) {
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if !strings.EqualFold(name, "max-age") {
+				continue
+			}
+			maxAge, err := strconv.ParseUint(strings.Trim(arg, `"`), 10, 32)
+			if err != nil {
+				return 0, false
+			}
+			return uint32(maxAge), true
+		}
+	}
+	return 0, false
+}
+
 type metricDNSClient struct {
-	client dnsClient
-	addr   string
+	client         dnsClient
+	addr           string
+	observe        func(time.Duration)
+	failurePenalty time.Duration
 }
 
-func newMetricDNSClient(client dnsClient, addr string) *metricDNSClient {
-	return &metricDNSClient{client, addr}
+func newMetricDNSClient(client dnsClient, addr string, opts ...metricDNSClientOption) *metricDNSClient {
+	c := &metricDNSClient{client: client, addr: addr}
+	// option pattern
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+type metricDNSClientOption func(c *metricDNSClient)
+
+// withMetricLatencyObserver sets the function that is called with the duration of each successful request.
+// Failed requests are observed with failurePenalty, so that an upstream that fails fast doesn't look fast.
+// Cancelled requests, e.g. the losers of a race, are not observed.
+func withMetricLatencyObserver(observe func(time.Duration), failurePenalty time.Duration) metricDNSClientOption {
+	return func(c *metricDNSClient) {
+		c.observe = observe
+		c.failurePenalty = failurePenalty
+	}
 }
 
 func (c *metricDNSClient) Query(ctx context.Context, dnsreq []byte) (r *dns.Msg, err error) {
 	start := time.Now()
 
 	// decorator pattern
-	if r, err = c.client.Query(ctx, dnsreq); err != nil {
+	r, err = c.client.Query(ctx, dnsreq)
+	if c.observe != nil {
+		c.observeLatency(ctx, time.Since(start), err)
+	}
+	if err != nil {
 		return
 	}
 
@@ -115,29 +328,57 @@ func (c *metricDNSClient) Query(ctx context.Context, dnsreq []byte) (r *dns.Msg,
 	return
 }
 
+func (c *metricDNSClient) observeLatency(ctx context.Context, d time.Duration, err error) {
+	switch {
+	case err == nil:
+		c.observe(d)
+	case errors.Is(ctx.Err(), context.Canceled):
+		// the latency of the cancelled request is unknown
+	default:
+		if d < c.failurePenalty {
+			d = c.failurePenalty
+		}
+		c.observe(d)
+	}
+}
+
 func newLoadBalanceDNSClient(clients []dnsClient, opts ...lbDNSClientOption) *lbDNSClient {
 	c := &lbDNSClient{
-		p:        newRandomPolicy(),
-		maxFails: len(clients),
-		timeout:  defaultRequestTimeout,
-		clients:  clients,
+		p:           newRandomPolicy(),
+		maxAttempts: len(clients),
+		timeout:     defaultRequestTimeout,
+		clients:     clients,
 	}
 	// option pattern
 	for _, o := range opts {
 		o(c)
 	}
-	if len(clients) < c.maxFails {
-		c.maxFails = len(clients)
+	if len(clients) < c.maxAttempts {
+		c.maxAttempts = len(clients)
 	}
+	c.feedback, _ = c.p.(feedbackPolicy)
 	return c
 }
 
 // lbDNSClient is a DNS client that load balances DNS requests between the list of DNS clients.
 type lbDNSClient struct {
-	p        policy
-	timeout  time.Duration
-	maxFails int
-	clients  []dnsClient
+	p           policy
+	timeout     time.Duration
+	deadline    time.Duration
+	maxAttempts int
+	clients     []dnsClient
+	health      []upstreamHealth
+	breakers    []*circuitBreaker
+	// the policy that tracks in-flight requests, nil if the policy does not need it
+	feedback feedbackPolicy
+
+	hedgeDelay time.Duration
+	hedgeMax   int
+	race       int
+	// nextRcodes are the response codes after which the next client is tried
+	nextRcodes []int
+	// client names used in metrics
+	names []string
 }
 
 type lbDNSClientOption func(c *lbDNSClient)
@@ -154,24 +395,252 @@ func withLbRequestTimeout(timeout time.Duration) lbDNSClientOption {
 	}
 }
 
-func withLbMaxFails(maxFails int) lbDNSClientOption {
+func withLbMaxAttempts(maxAttempts int) lbDNSClientOption {
+	return func(c *lbDNSClient) {
+		c.maxAttempts = maxAttempts
+	}
+}
+
+// withLbHedge enables hedged requests: if there is no response within delay,
+// the same request is sent to the next client, up to maxHedges hedged requests.
+func withLbHedge(delay time.Duration, maxHedges int) lbDNSClientOption {
+	return func(c *lbDNSClient) {
+		c.hedgeDelay = delay
+		c.hedgeMax = maxHedges
+	}
+}
+
+// withLbRace enables racing: the request is sent to k clients simultaneously
+// and the first successful response is returned.
+func withLbRace(k int) lbDNSClientOption {
+	return func(c *lbDNSClient) {
+		c.race = k
+	}
+}
+
+// withLbNextRcodes sets the response codes that are treated as failures: the next client is tried
+// and the last of such responses is returned if all attempts fail.
+func withLbNextRcodes(rcodes []int) lbDNSClientOption {
+	return func(c *lbDNSClient) {
+		c.nextRcodes = rcodes
+	}
+}
+
+// withLbNames sets the names of clients used in metrics.
+func withLbNames(names []string) lbDNSClientOption {
+	return func(c *lbDNSClient) {
+		c.names = names
+	}
+}
+
+// withLbDeadline sets the overall timeout of the request across all attempts.
+func withLbDeadline(deadline time.Duration) lbDNSClientOption {
 	return func(c *lbDNSClient) {
-		c.maxFails = maxFails
+		c.deadline = deadline
+	}
+}
+
+// withLbHealth sets the health of each client, down clients are skipped unless all clients are down.
+func withLbHealth(health []upstreamHealth) lbDNSClientOption {
+	return func(c *lbDNSClient) {
+		c.health = health
+	}
+}
+
+// withLbCircuitBreakers sets the circuit breaker of each client, clients with open circuit
+// are skipped unless all clients are down.
+func withLbCircuitBreakers(breakers []*circuitBreaker) lbDNSClientOption {
+	return func(c *lbDNSClient) {
+		c.breakers = breakers
 	}
 }
 
 func (c *lbDNSClient) Query(ctx context.Context, dnsreq []byte) (r *dns.Msg, err error) {
-	ids := c.p.List(len(c.clients))
-	for i := 0; i < c.maxFails; i++ {
-		if r, err = c.query(ctx, dnsreq, ids[i]); err == nil {
-			return
+	if c.deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.deadline)
+		defer cancel()
+	}
+	ids := c.available(c.p.List(len(c.clients), dnsreq), c.maxAttempts)
+	if c.hedgeDelay > 0 || c.race > 1 {
+		return c.queryParallel(ctx, dnsreq, ids)
+	}
+	// the last response with one of nextRcodes
+	var nextResp *dns.Msg
+	for _, id := range ids {
+		r, err = c.query(ctx, dnsreq, id)
+		if err == nil && c.isNextRcode(r.Rcode) {
+			nextResp = r
+			continue
+		}
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil && nextResp != nil {
+		return nextResp, nil
+	}
+	return
+}
+
+// isNextRcode reports whether the next client is tried after the response with the rcode.
+func (c *lbDNSClient) isNextRcode(rcode int) bool {
+	for _, rc := range c.nextRcodes {
+		if rc == rcode {
+			return true
+		}
+	}
+	return false
+}
+
+type lbQueryResult struct {
+	id     int
+	r      *dns.Msg
+	err    error
+	hedged bool
+}
+
+// queryParallel sends the request to the first race clients simultaneously (one client if race is disabled).
+// If hedging is enabled and there is no response within hedgeDelay, the same request is sent to the next
+// client, up to hedgeMax hedged requests. If a request fails or its response has one of nextRcodes,
+// the next client is tried immediately. The first successful response is returned and the rest requests
+// are cancelled.
+func (c *lbDNSClient) queryParallel(ctx context.Context, dnsreq []byte, ids []int) (r *dns.Msg, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// buffered channel, so that cancelled requests do not block
+	results := make(chan lbQueryResult, len(ids))
+	next, inflight := 0, 0
+	start := func(hedged bool) {
+		id := ids[next]
+		next++
+		inflight++
+		go func() {
+			r, err := c.query(ctx, dnsreq, id)
+			results <- lbQueryResult{id, r, err, hedged}
+		}()
+	}
+
+	start(false)
+	for next < c.race && next < len(ids) {
+		start(false)
+	}
+
+	// the timer channel is nil and never fires if hedging is disabled
+	var hedgeTimer <-chan time.Time
+	var timer *time.Timer
+	if c.hedgeDelay > 0 {
+		timer = time.NewTimer(c.hedgeDelay)
+		defer timer.Stop()
+		hedgeTimer = timer.C
+	}
+	// the last response with one of nextRcodes
+	var nextResp *dns.Msg
+	for hedges := 0; inflight > 0; {
+		select {
+		case res := <-results:
+			inflight--
+			if res.err == nil && !c.isNextRcode(res.r.Rcode) {
+				c.recordWin(res)
+				return res.r, nil
+			}
+			if res.err == nil {
+				nextResp = res.r
+			} else {
+				r, err = res.r, res.err
+			}
+			if next < len(ids) && ctx.Err() == nil {
+				start(false)
+			}
+		case <-hedgeTimer:
+			if next < len(ids) && hedges < c.hedgeMax {
+				hedges++
+				HedgeCount.Add(1)
+				start(true)
+				timer.Reset(c.hedgeDelay)
+			}
 		}
 	}
+	if nextResp != nil {
+		return nextResp, nil
+	}
 	return
 }
 
-func (c *lbDNSClient) query(ctx context.Context, dnsreq []byte, clientID int) (*dns.Msg, error) {
-	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+// recordWin records the metrics of the request that answered the query.
+func (c *lbDNSClient) recordWin(res lbQueryResult) {
+	if res.hedged {
+		HedgeWinCount.Add(1)
+	}
+	if c.race > 1 {
+		RaceWinCount.WithLabelValues(c.name(res.id)).Add(1)
+	}
+}
+
+// name returns the name of the client used in metrics.
+func (c *lbDNSClient) name(id int) string {
+	if id < len(c.names) {
+		return c.names[id]
+	}
+	return strconv.Itoa(id)
+}
+
+// available filters out down clients from the list of client ids and returns at most max of them.
+// If all clients are down, the list is returned as is. The clients after the first max available ones
+// are not checked, so that they don't take the trial request of the half-open circuit they won't send.
+func (c *lbDNSClient) available(ids []int, max int) []int {
+	if len(c.health) == 0 && len(c.breakers) == 0 {
+		return truncateIDs(ids, max)
+	}
+	result := make([]int, 0, len(ids))
+	for _, id := range ids {
+		if len(result) == max {
+			break
+		}
+		if !c.down(id) {
+			result = append(result, id)
+		}
+	}
+	if len(result) == 0 {
+		return truncateIDs(ids, max)
+	}
+	return result
+}
+
+func truncateIDs(ids []int, max int) []int {
+	if len(ids) > max {
+		return ids[:max]
+	}
+	return ids
+}
+
+func (c *lbDNSClient) down(id int) bool {
+	return (len(c.health) > 0 && c.health[id].Down()) ||
+		(len(c.breakers) > 0 && c.breakers[id].Down())
+}
+
+func (c *lbDNSClient) query(ctx context.Context, dnsreq []byte, clientID int) (r *dns.Msg, err error) {
+	if c.feedback != nil {
+		c.feedback.Start(clientID)
+		defer c.feedback.Finish(clientID)
+	}
+	queryCtx, cancel := context.WithTimeout(ctx, c.timeout)
 	defer cancel()
-	return c.clients[clientID].Query(ctx, dnsreq)
+	r, err = c.clients[clientID].Query(queryCtx, dnsreq)
+	if len(c.breakers) > 0 {
+		c.record(ctx, clientID, err)
+	}
+	return
+}
+
+// record records the result of the request in the circuit breaker of the client.
+func (c *lbDNSClient) record(ctx context.Context, clientID int, err error) {
+	switch {
+	case err == nil:
+		c.breakers[clientID].Success()
+	case ctx.Err() == nil:
+		// the failure is not caused by the cancelled parent request
+		c.breakers[clientID].Failure()
+	}
 }
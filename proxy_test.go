@@ -3,14 +3,19 @@ package https
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"errors"
 	"io"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
 )
 
@@ -48,6 +53,29 @@ func packMsg(t *testing.T, msg *dns.Msg) []byte {
 	return data
 }
 
+func TestUnpackRequest(t *testing.T) {
+	msg := newRequestDNSMsg()
+	data := packMsg(t, msg)
+	ctx := withRequest(context.Background(), data, msg)
+
+	req, err := unpackRequest(ctx, data)
+	require.NoError(t, err)
+	require.Same(t, msg, req, "the message of the same request must not be unpacked again")
+
+	rewritten := append([]byte(nil), data...)
+	req, err = unpackRequest(ctx, rewritten)
+	require.NoError(t, err)
+	require.NotSame(t, msg, req)
+	require.Equal(t, msg.Question, req.Question)
+
+	_, err = unpackRequest(ctx, []byte("abc"))
+	require.Error(t, err)
+
+	noQuestion := new(dns.Msg)
+	_, err = unpackRequest(context.Background(), packMsg(t, noQuestion))
+	require.ErrorIs(t, err, errMalformedRequest)
+}
+
 func TestDNSClient(t *testing.T) {
 	callCount := 0
 	expectedMsg := newExpectedDNSMsg()
@@ -84,6 +112,82 @@ func TestDNSClient(t *testing.T) {
 	require.Equal(t, expectedMsg.Answer[0].String(), result.Answer[0].String())
 }
 
+func TestDNSClientGetMethod(t *testing.T) {
+	reqMsg := newRequestDNSMsg()
+	reqMsg.Id = 1234
+	dnsreq := packMsg(t, reqMsg)
+
+	callCount := 0
+	httpClient := mockHTTPClientFunc(func(req *http.Request) (resp *http.Response, err error) {
+		callCount++
+		acceptHdrs := req.Header["Accept"]
+		require.NotEmpty(t, acceptHdrs, "Accept header is empty")
+		require.Equal(t, dnsMessageMimeType, acceptHdrs[0], "invalid accept header")
+		require.Equal(t, "GET", req.Method, "invalid request method")
+
+		data, err := base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+		require.NoError(t, err)
+		msg := new(dns.Msg)
+		require.NoError(t, msg.Unpack(data))
+		require.Equal(t, uint16(0), msg.Id, "DNS message ID must be zero")
+		require.Equal(t, reqMsg.Question, msg.Question)
+
+		resp = &http.Response{
+			Body:       io.NopCloser(bytes.NewReader(packMsg(t, newExpectedDNSMsg()))),
+			StatusCode: http.StatusOK,
+		}
+		return
+	})
+	dnsClient := newDoHDNSClient(httpClient, upstreamURL, withDoHMethod(http.MethodGet))
+
+	result, err := dnsClient.Query(context.Background(), dnsreq)
+	require.NoError(t, err)
+	require.Equal(t, 1, callCount, "invalid http client call count")
+	require.Equal(t, uint16(1234), result.Id, "original DNS message ID must be restored")
+	require.Equal(t, newExpectedDNSMsg().Answer[0].String(), result.Answer[0].String())
+}
+
+func TestDNSClientGetMethodURLWithQuery(t *testing.T) {
+	dnsreq := packMsg(t, newRequestDNSMsg())
+	httpClient := mockHTTPClientFunc(func(req *http.Request) (resp *http.Response, err error) {
+		require.Equal(t, "GET", req.Method, "invalid request method")
+		require.Equal(t, "abc", req.URL.Query().Get("key"))
+		require.NotEmpty(t, req.URL.Query().Get("dns"))
+		resp = &http.Response{
+			Body:       io.NopCloser(bytes.NewReader(packMsg(t, newExpectedDNSMsg()))),
+			StatusCode: http.StatusOK,
+		}
+		return
+	})
+	dnsClient := newDoHDNSClient(httpClient, upstreamURL+"?key=abc", withDoHMethod(http.MethodGet))
+
+	_, err := dnsClient.Query(context.Background(), dnsreq)
+	require.NoError(t, err)
+}
+
+func TestDNSClientGetMethodFallbackToPost(t *testing.T) {
+	dnsreq := packMsg(t, newRequestDNSMsg())
+	httpClient := mockHTTPClientFunc(func(req *http.Request) (resp *http.Response, err error) {
+		require.Equal(t, upstreamURL, req.URL.String(), "invalid request URL")
+		require.Equal(t, "POST", req.Method, "invalid request method")
+
+		buf, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		require.Equal(t, dnsreq, buf, "invalid request body")
+
+		resp = &http.Response{
+			Body:       io.NopCloser(bytes.NewReader(packMsg(t, newExpectedDNSMsg()))),
+			StatusCode: http.StatusOK,
+		}
+		return
+	})
+	dnsClient := newDoHDNSClient(httpClient, upstreamURL,
+		withDoHMethod(http.MethodGet), withDoHMaxGetURLLength(len(upstreamURL)+10))
+
+	_, err := dnsClient.Query(context.Background(), dnsreq)
+	require.NoError(t, err)
+}
+
 func TestDNSClientNewRequestError(t *testing.T) {
 	invalidURL := "https://example.com/\t\n"
 	httpClient := mockHTTPClientFunc(func(req *http.Request) (resp *http.Response, err error) {
@@ -176,7 +280,7 @@ func TestDNSClientLargeResponseError(t *testing.T) {
 	var buf bytes.Buffer
 	dnsMsg := packMsg(t, newExpectedDNSMsg())
 	buf.Write(dnsMsg)
-	buf.WriteString(strings.Repeat("a", maxDNSMessageSize))
+	buf.WriteString(strings.Repeat("a", defaultMaxDNSMessageSize))
 
 	httpClient := mockHTTPClientFunc(func(req *http.Request) (resp *http.Response, err error) {
 		resp = &http.Response{
@@ -191,6 +295,165 @@ func TestDNSClientLargeResponseError(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestDNSClientMaxMessageSize(t *testing.T) {
+	dnsMsg := packMsg(t, newExpectedDNSMsg())
+	httpClient := mockHTTPClientFunc(func(req *http.Request) (resp *http.Response, err error) {
+		resp = &http.Response{
+			Body:       io.NopCloser(bytes.NewReader(dnsMsg)),
+			StatusCode: http.StatusOK,
+		}
+		return
+	})
+
+	dnsClient := newDoHDNSClient(httpClient, upstreamURL, withDoHMaxMessageSize(len(dnsMsg)))
+	_, err := dnsClient.Query(context.Background(), []byte("abc"))
+	require.NoError(t, err)
+
+	dnsClient = newDoHDNSClient(httpClient, upstreamURL, withDoHMaxMessageSize(len(dnsMsg)-1))
+	_, err = dnsClient.Query(context.Background(), []byte("abc"))
+	require.ErrorIs(t, err, errResponseTooLarge)
+}
+
+func TestDNSClientResponseTTL(t *testing.T) {
+	tests := []struct {
+		name        string
+		header      http.Header
+		expectedTTL uint32
+	}{
+		{
+			name:        "NoCacheHeaders",
+			header:      http.Header{},
+			expectedTTL: 30,
+		},
+		{
+			name:        "Age",
+			header:      http.Header{"Age": {"10"}},
+			expectedTTL: 20,
+		},
+		{
+			name:        "AgeGreaterThanTTL",
+			header:      http.Header{"Age": {"100"}},
+			expectedTTL: 0,
+		},
+		{
+			name:        "MaxAge",
+			header:      http.Header{"Cache-Control": {"public, max-age=10"}},
+			expectedTTL: 10,
+		},
+		{
+			name:        "MaxAgeGreaterThanTTL",
+			header:      http.Header{"Cache-Control": {"max-age=100"}},
+			expectedTTL: 30,
+		},
+		{
+			name:        "MaxAgeAndAge",
+			header:      http.Header{"Cache-Control": {"max-age=15"}, "Age": {"10"}},
+			expectedTTL: 5,
+		},
+		{
+			name:        "InvalidHeaders",
+			header:      http.Header{"Cache-Control": {"max-age=abc"}, "Age": {"-1"}},
+			expectedTTL: 30,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpClient := mockHTTPClientFunc(func(req *http.Request) (resp *http.Response, err error) {
+				resp = &http.Response{
+					Header:     tt.header,
+					Body:       io.NopCloser(bytes.NewReader(packMsg(t, newExpectedDNSMsg()))),
+					StatusCode: http.StatusOK,
+				}
+				return
+			})
+			dnsClient := newDoHDNSClient(httpClient, upstreamURL)
+
+			result, err := dnsClient.Query(context.Background(), []byte("abc"))
+			require.NoError(t, err)
+			require.Len(t, result.Answer, 1)
+			require.Equal(t, tt.expectedTTL, result.Answer[0].Header().Ttl)
+		})
+	}
+}
+
+func TestMetricDNSClientLatencyObserver(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		cancel      bool
+		expectedMin time.Duration
+		expectedLen int
+	}{
+		{
+			name:        "Success",
+			expectedMin: 10 * time.Millisecond,
+			expectedLen: 1,
+		},
+		{
+			name:        "Error",
+			err:         errors.New("client error"),
+			expectedMin: time.Second,
+			expectedLen: 1,
+		},
+		{
+			name:        "Cancelled",
+			err:         context.Canceled,
+			cancel:      true,
+			expectedLen: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			client := mockDNSClientFunc(func(_ context.Context, _ []byte) (*dns.Msg, error) {
+				time.Sleep(10 * time.Millisecond)
+				if tt.cancel {
+					cancel()
+				}
+				return newExpectedDNSMsg(), tt.err
+			})
+			var observed []time.Duration
+			metricClient := newMetricDNSClient(client, upstreamURL, withMetricLatencyObserver(func(d time.Duration) {
+				observed = append(observed, d)
+			}, time.Second))
+
+			_, err := metricClient.Query(ctx, []byte("abc"))
+			require.Equal(t, tt.err, err)
+			require.Len(t, observed, tt.expectedLen)
+			if tt.expectedLen > 0 {
+				require.GreaterOrEqual(t, observed[0], tt.expectedMin)
+			}
+		})
+	}
+}
+
+func TestLoadBalanceDNSClientFastestPolicyFailingUpstream(t *testing.T) {
+	p := newFastestPolicy()
+	p.exploreRate = 0
+	failing := mockDNSClientFunc(func(_ context.Context, _ []byte) (*dns.Msg, error) {
+		return nil, errors.New("connection refused")
+	})
+	healthy := mockDNSClientFunc(func(_ context.Context, _ []byte) (*dns.Msg, error) {
+		time.Sleep(20 * time.Millisecond)
+		return newExpectedDNSMsg(), nil
+	})
+	clients := make([]dnsClient, 2)
+	for i, client := range []dnsClient{failing, healthy} {
+		id := i
+		clients[i] = newMetricDNSClient(client, strconv.Itoa(i), withMetricLatencyObserver(func(d time.Duration) {
+			p.Observe(id, d)
+		}, defaultRequestTimeout))
+	}
+	lbClient := newLoadBalanceDNSClient(clients, withLbPolicy(p))
+
+	for i := 0; i < 10; i++ {
+		_, err := lbClient.Query(context.Background(), []byte("abc"))
+		require.NoError(t, err)
+	}
+	require.Equal(t, []int{1, 0}, p.List(2, nil), "the failing upstream must be tried last")
+}
+
 type mockDNSClient struct {
 	callCount int
 	reqBody   []byte
@@ -259,22 +522,49 @@ func TestLoadBalanceDNSClientPolicy(t *testing.T) {
 	require.Equal(t, newExpectedDNSMsg(), result)
 }
 
-func TestLoadBalanceDNSClientMaxFails(t *testing.T) {
+type mockFeedbackPolicy struct {
+	policy
+	started  []int
+	finished []int
+}
+
+func (p *mockFeedbackPolicy) Start(id int) {
+	p.started = append(p.started, id)
+}
+
+func (p *mockFeedbackPolicy) Finish(id int) {
+	p.finished = append(p.finished, id)
+}
+
+func TestLoadBalanceDNSClientFeedbackPolicy(t *testing.T) {
+	client1 := &mockDNSClient{reqBody: []byte("abc"), t: t, err: errors.New("client error")}
+	client2 := &mockDNSClient{reqBody: []byte("abc"), t: t}
+	clients := []dnsClient{client1, client2}
+	p := &mockFeedbackPolicy{policy: newSequentialPolicy()}
+	lbClient := newLoadBalanceDNSClient(clients, withLbPolicy(p))
+
+	_, err := lbClient.Query(context.Background(), []byte("abc"))
+	require.NoError(t, err)
+	require.Equal(t, []int{0, 1}, p.started)
+	require.Equal(t, []int{0, 1}, p.finished)
+}
+
+func TestLoadBalanceDNSClientMaxAttempts(t *testing.T) {
 	tests := []struct {
 		name             string
-		maxFails         int
+		maxAttempts      int
 		callCountClient1 int
 		callCountClient2 int
 	}{
 		{
-			name:             "OneMaxFail",
-			maxFails:         1,
+			name:             "OneMaxAttempt",
+			maxAttempts:      1,
 			callCountClient1: 1,
 			callCountClient2: 0,
 		},
 		{
-			name:             "TenMaxFails",
-			maxFails:         10,
+			name:             "TenMaxAttempts",
+			maxAttempts:      10,
 			callCountClient1: 1,
 			callCountClient2: 1,
 		},
@@ -289,7 +579,7 @@ func TestLoadBalanceDNSClientMaxFails(t *testing.T) {
 			lbClient := newLoadBalanceDNSClient(clients,
 				withLbPolicy(newSequentialPolicy()),
 				withLbRequestTimeout(defaultRequestTimeout),
-				withLbMaxFails(tt.maxFails))
+				withLbMaxAttempts(tt.maxAttempts))
 
 			result, err := lbClient.Query(context.Background(), []byte("abc"))
 			require.Error(t, err)
@@ -300,12 +590,385 @@ func TestLoadBalanceDNSClientMaxFails(t *testing.T) {
 	}
 }
 
+func TestLoadBalanceDNSClientDeadline(t *testing.T) {
+	callCount := 0
+	client := mockDNSClientFunc(func(ctx context.Context, _ []byte) (*dns.Msg, error) {
+		callCount++
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	clients := []dnsClient{client, client, client}
+	lbClient := newLoadBalanceDNSClient(clients,
+		withLbRequestTimeout(30*time.Millisecond),
+		withLbDeadline(50*time.Millisecond))
+
+	start := time.Now()
+	_, err := lbClient.Query(context.Background(), []byte("abc"))
+	require.Error(t, err)
+	require.Less(t, time.Since(start), 500*time.Millisecond)
+	require.Equal(t, 2, callCount, "attempts must stop after the deadline")
+}
+
+// newSlowDNSClient returns a DNS client that replies after delay or fails when the request is cancelled.
+func newSlowDNSClient(delay time.Duration, callCount *int32, cancelled *int32) dnsClient {
+	return mockDNSClientFunc(func(ctx context.Context, _ []byte) (*dns.Msg, error) {
+		atomic.AddInt32(callCount, 1)
+		select {
+		case <-time.After(delay):
+			return newExpectedDNSMsg(), nil
+		case <-ctx.Done():
+			atomic.AddInt32(cancelled, 1)
+			return nil, ctx.Err()
+		}
+	})
+}
+
+func TestLoadBalanceDNSClientHedge(t *testing.T) {
+	var callCount1, callCount2, cancelled1, cancelled2 int32
+	clients := []dnsClient{
+		newSlowDNSClient(time.Second, &callCount1, &cancelled1),
+		newSlowDNSClient(0, &callCount2, &cancelled2),
+	}
+	lbClient := newLoadBalanceDNSClient(clients,
+		withLbPolicy(newSequentialPolicy()),
+		withLbHedge(20*time.Millisecond, 1))
+	hedgeCount := testutil.ToFloat64(HedgeCount)
+	hedgeWinCount := testutil.ToFloat64(HedgeWinCount)
+
+	start := time.Now()
+	result, err := lbClient.Query(context.Background(), []byte("abc"))
+	require.NoError(t, err)
+	require.Equal(t, newExpectedDNSMsg(), result)
+	require.Less(t, time.Since(start), 500*time.Millisecond)
+	require.Equal(t, int32(1), atomic.LoadInt32(&callCount1))
+	require.Equal(t, int32(1), atomic.LoadInt32(&callCount2))
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&cancelled1) == 1
+	}, time.Second, 10*time.Millisecond, "slow request must be cancelled")
+	require.Equal(t, hedgeCount+1, testutil.ToFloat64(HedgeCount))
+	require.Equal(t, hedgeWinCount+1, testutil.ToFloat64(HedgeWinCount))
+}
+
+func TestLoadBalanceDNSClientHedgeFastResponse(t *testing.T) {
+	var callCount1, callCount2, cancelled int32
+	clients := []dnsClient{
+		newSlowDNSClient(0, &callCount1, &cancelled),
+		newSlowDNSClient(0, &callCount2, &cancelled),
+	}
+	lbClient := newLoadBalanceDNSClient(clients,
+		withLbPolicy(newSequentialPolicy()),
+		withLbHedge(100*time.Millisecond, 1))
+	hedgeCount := testutil.ToFloat64(HedgeCount)
+
+	_, err := lbClient.Query(context.Background(), []byte("abc"))
+	require.NoError(t, err)
+	require.Equal(t, int32(1), atomic.LoadInt32(&callCount1))
+	require.Equal(t, int32(0), atomic.LoadInt32(&callCount2), "hedged request must not be sent")
+	require.Equal(t, hedgeCount, testutil.ToFloat64(HedgeCount))
+}
+
+func TestLoadBalanceDNSClientHedgeFailover(t *testing.T) {
+	client1 := mockDNSClientFunc(func(_ context.Context, _ []byte) (*dns.Msg, error) {
+		return nil, errors.New("client error")
+	})
+	var callCount2, cancelled int32
+	clients := []dnsClient{client1, newSlowDNSClient(0, &callCount2, &cancelled)}
+	lbClient := newLoadBalanceDNSClient(clients,
+		withLbPolicy(newSequentialPolicy()),
+		withLbHedge(time.Second, 1))
+	hedgeCount := testutil.ToFloat64(HedgeCount)
+
+	start := time.Now()
+	result, err := lbClient.Query(context.Background(), []byte("abc"))
+	require.NoError(t, err)
+	require.Equal(t, newExpectedDNSMsg(), result)
+	require.Less(t, time.Since(start), 500*time.Millisecond, "failed request must be retried without hedge delay")
+	require.Equal(t, int32(1), atomic.LoadInt32(&callCount2))
+	require.Equal(t, hedgeCount, testutil.ToFloat64(HedgeCount))
+}
+
+func TestLoadBalanceDNSClientHedgeMax(t *testing.T) {
+	var callCount, cancelled int32
+	client := newSlowDNSClient(time.Second, &callCount, &cancelled)
+	clients := []dnsClient{client, client, client}
+	lbClient := newLoadBalanceDNSClient(clients,
+		withLbRequestTimeout(100*time.Millisecond),
+		withLbHedge(10*time.Millisecond, 1))
+
+	_, err := lbClient.Query(context.Background(), []byte("abc"))
+	require.Error(t, err)
+	// the first request, one hedged request and one request after the first request timeout
+	require.Equal(t, int32(3), atomic.LoadInt32(&callCount))
+}
+
+func TestLoadBalanceDNSClientHedgeAllFailed(t *testing.T) {
+	client := mockDNSClientFunc(func(_ context.Context, _ []byte) (*dns.Msg, error) {
+		return newExpectedDNSMsg(), errors.New("client error")
+	})
+	lbClient := newLoadBalanceDNSClient([]dnsClient{client, client}, withLbHedge(10*time.Millisecond, 1))
+
+	result, err := lbClient.Query(context.Background(), []byte("abc"))
+	require.Error(t, err)
+	require.Equal(t, newExpectedDNSMsg(), result)
+}
+
+func TestLoadBalanceDNSClientRace(t *testing.T) {
+	var callCount1, callCount2, callCount3, cancelled1, cancelled int32
+	clients := []dnsClient{
+		newSlowDNSClient(time.Second, &callCount1, &cancelled1),
+		newSlowDNSClient(0, &callCount2, &cancelled),
+		newSlowDNSClient(0, &callCount3, &cancelled),
+	}
+	lbClient := newLoadBalanceDNSClient(clients,
+		withLbPolicy(newSequentialPolicy()),
+		withLbNames([]string{"race1", "race2", "race3"}),
+		withLbRace(2))
+	raceWinCount1 := testutil.ToFloat64(RaceWinCount.WithLabelValues("race1"))
+	raceWinCount2 := testutil.ToFloat64(RaceWinCount.WithLabelValues("race2"))
+
+	start := time.Now()
+	result, err := lbClient.Query(context.Background(), []byte("abc"))
+	require.NoError(t, err)
+	require.Equal(t, newExpectedDNSMsg(), result)
+	require.Less(t, time.Since(start), 500*time.Millisecond)
+	require.Equal(t, int32(1), atomic.LoadInt32(&callCount2))
+	require.Equal(t, int32(0), atomic.LoadInt32(&callCount3))
+	// the slow request may be started after the response of the fast one
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&callCount1) == 1 && atomic.LoadInt32(&cancelled1) == 1
+	}, time.Second, 10*time.Millisecond, "slow request must be cancelled")
+	require.Equal(t, raceWinCount1, testutil.ToFloat64(RaceWinCount.WithLabelValues("race1")))
+	require.Equal(t, raceWinCount2+1, testutil.ToFloat64(RaceWinCount.WithLabelValues("race2")))
+}
+
+func TestLoadBalanceDNSClientRaceFailover(t *testing.T) {
+	client1 := mockDNSClientFunc(func(_ context.Context, _ []byte) (*dns.Msg, error) {
+		return nil, errors.New("client error")
+	})
+	var callCount2, callCount3, cancelled int32
+	clients := []dnsClient{
+		client1,
+		newSlowDNSClient(time.Second, &callCount2, &cancelled),
+		newSlowDNSClient(0, &callCount3, &cancelled),
+	}
+	lbClient := newLoadBalanceDNSClient(clients, withLbPolicy(newSequentialPolicy()), withLbRace(2))
+
+	start := time.Now()
+	result, err := lbClient.Query(context.Background(), []byte("abc"))
+	require.NoError(t, err)
+	require.Equal(t, newExpectedDNSMsg(), result)
+	require.Less(t, time.Since(start), 500*time.Millisecond)
+	require.Equal(t, int32(1), atomic.LoadInt32(&callCount3), "the next client must be tried after failure")
+	// the slow request may be started after the response of the next client
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&callCount2) == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func newRcodeDNSClient(rcode int, callCount *int32) dnsClient {
+	return mockDNSClientFunc(func(_ context.Context, _ []byte) (*dns.Msg, error) {
+		atomic.AddInt32(callCount, 1)
+		r := newExpectedDNSMsg()
+		r.Rcode = rcode
+		return r, nil
+	})
+}
+
+func TestLoadBalanceDNSClientNextRcodes(t *testing.T) {
+	tests := []struct {
+		name          string
+		rcodes        []int
+		expectedRcode int
+		expectedCalls []int32
+	}{
+		{
+			name:          "NoNextRcodes",
+			expectedRcode: dns.RcodeServerFailure,
+			expectedCalls: []int32{1, 0, 0},
+		},
+		{
+			name:          "ServFail",
+			rcodes:        []int{dns.RcodeServerFailure},
+			expectedRcode: dns.RcodeRefused,
+			expectedCalls: []int32{1, 1, 0},
+		},
+		{
+			name:          "ServFailAndRefused",
+			rcodes:        []int{dns.RcodeServerFailure, dns.RcodeRefused},
+			expectedRcode: dns.RcodeSuccess,
+			expectedCalls: []int32{1, 1, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			callCounts := make([]int32, 3)
+			clients := []dnsClient{
+				newRcodeDNSClient(dns.RcodeServerFailure, &callCounts[0]),
+				newRcodeDNSClient(dns.RcodeRefused, &callCounts[1]),
+				newRcodeDNSClient(dns.RcodeSuccess, &callCounts[2]),
+			}
+			lbClient := newLoadBalanceDNSClient(clients, withLbPolicy(newSequentialPolicy()),
+				withLbNextRcodes(tt.rcodes))
+
+			result, err := lbClient.Query(context.Background(), []byte("abc"))
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedRcode, result.Rcode)
+			require.Equal(t, tt.expectedCalls, callCounts)
+		})
+	}
+}
+
+func TestLoadBalanceDNSClientNextRcodesDeadline(t *testing.T) {
+	for _, race := range []int{0, 2} {
+		var callCount int32
+		clients := []dnsClient{
+			newRcodeDNSClient(dns.RcodeServerFailure, &callCount),
+			mockDNSClientFunc(func(ctx context.Context, _ []byte) (*dns.Msg, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}),
+		}
+		lbClient := newLoadBalanceDNSClient(clients, withLbPolicy(newSequentialPolicy()),
+			withLbNextRcodes([]int{dns.RcodeServerFailure}), withLbRace(race),
+			withLbRequestTimeout(time.Second), withLbDeadline(50*time.Millisecond))
+
+		result, err := lbClient.Query(context.Background(), []byte("abc"))
+		require.NoError(t, err)
+		require.Equal(t, dns.RcodeServerFailure, result.Rcode, "the kept response must be returned after the deadline")
+	}
+}
+
+func TestLoadBalanceDNSClientNextRcodesRace(t *testing.T) {
+	var callCount1, callCount2, callCount3 int32
+	clients := []dnsClient{
+		newRcodeDNSClient(dns.RcodeServerFailure, &callCount1),
+		newRcodeDNSClient(dns.RcodeRefused, &callCount2),
+		newRcodeDNSClient(dns.RcodeSuccess, &callCount3),
+	}
+	lbClient := newLoadBalanceDNSClient(clients, withLbPolicy(newSequentialPolicy()),
+		withLbNextRcodes([]int{dns.RcodeServerFailure, dns.RcodeRefused}), withLbRace(2))
+
+	result, err := lbClient.Query(context.Background(), []byte("abc"))
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeSuccess, result.Rcode)
+	require.Equal(t, int32(1), atomic.LoadInt32(&callCount3))
+}
+
+func TestLoadBalanceDNSClientNextRcodesLastResponse(t *testing.T) {
+	var callCount1, callCount2 int32
+	clients := []dnsClient{
+		newRcodeDNSClient(dns.RcodeServerFailure, &callCount1),
+		newRcodeDNSClient(dns.RcodeRefused, &callCount2),
+		mockDNSClientFunc(func(_ context.Context, _ []byte) (*dns.Msg, error) {
+			return nil, errors.New("client error")
+		}),
+	}
+	for _, race := range []int{0, 2} {
+		lbClient := newLoadBalanceDNSClient(clients, withLbPolicy(newSequentialPolicy()),
+			withLbNextRcodes([]int{dns.RcodeServerFailure, dns.RcodeRefused}), withLbRace(race))
+
+		result, err := lbClient.Query(context.Background(), []byte("abc"))
+		require.NoError(t, err)
+		require.Contains(t, []int{dns.RcodeServerFailure, dns.RcodeRefused}, result.Rcode)
+		if race == 0 {
+			require.Equal(t, dns.RcodeRefused, result.Rcode, "the last response must be returned")
+		}
+	}
+}
+
+type mockUpstreamHealth bool
+
+func (h mockUpstreamHealth) Down() bool {
+	return bool(h)
+}
+
+func TestLoadBalanceDNSClientSkipDownClients(t *testing.T) {
+	client1 := &mockDNSClient{reqBody: []byte("abc"), t: t}
+	client2 := &mockDNSClient{reqBody: []byte("abc"), t: t}
+	clients := []dnsClient{client1, client2}
+	health := []upstreamHealth{mockUpstreamHealth(true), mockUpstreamHealth(false)}
+	lbClient := newLoadBalanceDNSClient(clients, withLbPolicy(newSequentialPolicy()), withLbHealth(health))
+
+	result, err := lbClient.Query(context.Background(), []byte("abc"))
+	require.NoError(t, err)
+	require.Equal(t, 0, client1.callCount)
+	require.Equal(t, 1, client2.callCount)
+	require.Equal(t, newExpectedDNSMsg(), result)
+}
+
+func TestLoadBalanceDNSClientAllClientsDown(t *testing.T) {
+	client1 := &mockDNSClient{reqBody: []byte("abc"), t: t, err: errors.New("client error")}
+	client2 := &mockDNSClient{reqBody: []byte("abc"), t: t}
+	clients := []dnsClient{client1, client2}
+	health := []upstreamHealth{mockUpstreamHealth(true), mockUpstreamHealth(true)}
+	lbClient := newLoadBalanceDNSClient(clients, withLbPolicy(newSequentialPolicy()), withLbHealth(health))
+
+	result, err := lbClient.Query(context.Background(), []byte("abc"))
+	require.NoError(t, err)
+	require.Equal(t, 1, client1.callCount)
+	require.Equal(t, 1, client2.callCount)
+	require.Equal(t, newExpectedDNSMsg(), result)
+}
+
+func TestLoadBalanceDNSClientCircuitBreaker(t *testing.T) {
+	client1 := &mockDNSClient{reqBody: []byte("abc"), t: t, err: errors.New("client error")}
+	client2 := &mockDNSClient{reqBody: []byte("abc"), t: t}
+	clients := []dnsClient{client1, client2}
+	breakers := []*circuitBreaker{
+		newCircuitBreaker("client1", 2, time.Minute),
+		newCircuitBreaker("client2", 2, time.Minute),
+	}
+	lbClient := newLoadBalanceDNSClient(clients, withLbPolicy(newSequentialPolicy()), withLbCircuitBreakers(breakers))
+
+	for i := 0; i < 3; i++ {
+		result, err := lbClient.Query(context.Background(), []byte("abc"))
+		require.NoError(t, err)
+		require.Equal(t, newExpectedDNSMsg(), result)
+	}
+	require.Equal(t, 2, client1.callCount, "client with open circuit must be skipped")
+	require.Equal(t, 3, client2.callCount)
+	require.True(t, breakers[0].Down())
+	require.False(t, breakers[1].Down())
+}
+
+func TestLoadBalanceDNSClientCircuitBreakerHalfOpenNotTried(t *testing.T) {
+	client1 := &mockDNSClient{reqBody: []byte("abc"), t: t}
+	client2 := &mockDNSClient{reqBody: []byte("abc"), t: t}
+	breakers := []*circuitBreaker{
+		newCircuitBreaker("client1", 1, time.Minute),
+		newCircuitBreaker("client2", 1, time.Millisecond),
+	}
+	breakers[1].Failure()
+	time.Sleep(5 * time.Millisecond)
+	lbClient := newLoadBalanceDNSClient([]dnsClient{client1, client2},
+		withLbPolicy(newSequentialPolicy()), withLbMaxAttempts(1), withLbCircuitBreakers(breakers))
+
+	_, err := lbClient.Query(context.Background(), []byte("abc"))
+	require.NoError(t, err)
+	require.Equal(t, 0, client2.callCount)
+	require.False(t, breakers[1].Down(), "the trial request must not be taken by the client that is not tried")
+}
+
+func TestLoadBalanceDNSClientCircuitBreakerCancelledRequest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	client1 := mockDNSClientFunc(func(_ context.Context, _ []byte) (*dns.Msg, error) {
+		cancel()
+		return nil, context.Canceled
+	})
+	breakers := []*circuitBreaker{newCircuitBreaker("client1", 1, time.Minute)}
+	lbClient := newLoadBalanceDNSClient([]dnsClient{client1}, withLbCircuitBreakers(breakers))
+
+	_, err := lbClient.Query(ctx, []byte("abc"))
+	require.Error(t, err)
+	require.False(t, breakers[0].Down(), "cancelled requests must not open the circuit")
+}
+
 func TestDefaultNewLoadBalanceDNSClient(t *testing.T) {
 	client1 := &mockDNSClient{reqBody: []byte("abc"), t: t}
 	client2 := &mockDNSClient{reqBody: []byte("abc"), t: t}
 	clients := []dnsClient{client1, client2}
 
 	lbClient := newLoadBalanceDNSClient(clients)
-	require.Equal(t, 2, lbClient.maxFails)
+	require.Equal(t, 2, lbClient.maxAttempts)
 	require.Equal(t, defaultRequestTimeout, lbClient.timeout)
 }
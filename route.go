@@ -0,0 +1,73 @@
+package https
+
+import (
+	"context"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+)
+
+// upstreamRoute is a group of upstreams that serves queries for its domains and query types.
+type upstreamRoute struct {
+	name   string
+	client dnsClient
+	// domains are the names the query name must be equal to or a subdomain of, any name if empty
+	domains []string
+	// qtypes are the query types of the route, any type if empty
+	qtypes []uint16
+}
+
+func newUpstreamRoute(name string, client dnsClient, domains []string, qtypes []uint16) *upstreamRoute {
+	return &upstreamRoute{name: name, client: client, domains: domains, qtypes: qtypes}
+}
+
+func (r *upstreamRoute) match(q dns.Question) bool {
+	return r.matchDomain(q.Name) && r.matchQtype(q.Qtype)
+}
+
+func (r *upstreamRoute) matchDomain(name string) bool {
+	if len(r.domains) == 0 {
+		return true
+	}
+	for _, domain := range r.domains {
+		if plugin.Name(domain).Matches(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *upstreamRoute) matchQtype(qtype uint16) bool {
+	if len(r.qtypes) == 0 {
+		return true
+	}
+	for _, t := range r.qtypes {
+		if t == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// routeDNSClient is a DNS client that sends queries to the client of the first matching route,
+// queries that match no route are sent to the default client.
+type routeDNSClient struct {
+	routes []*upstreamRoute
+	client dnsClient
+}
+
+func newRouteDNSClient(routes []*upstreamRoute, defaultClient dnsClient) *routeDNSClient {
+	return &routeDNSClient{routes: routes, client: defaultClient}
+}
+
+func (c *routeDNSClient) Query(ctx context.Context, dnsreq []byte) (*dns.Msg, error) {
+	if req, err := unpackRequest(ctx, dnsreq); err == nil {
+		for _, r := range c.routes {
+			if r.match(req.Question[0]) {
+				RouteCount.WithLabelValues(r.name).Add(1)
+				return r.client.Query(ctx, dnsreq)
+			}
+		}
+	}
+	return c.client.Query(ctx, dnsreq)
+}
@@ -0,0 +1,76 @@
+package https
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func newNamedDNSClient(name string, calls *[]string) dnsClient {
+	return mockDNSClientFunc(func(_ context.Context, _ []byte) (*dns.Msg, error) {
+		*calls = append(*calls, name)
+		return newExpectedDNSMsg(), nil
+	})
+}
+
+func TestRouteDNSClient(t *testing.T) {
+	var calls []string
+	client := newRouteDNSClient([]*upstreamRoute{
+		newUpstreamRoute("corp", newNamedDNSClient("corp", &calls), []string{"corp.example."}, nil),
+		newUpstreamRoute("txt", newNamedDNSClient("txt", &calls), nil, []uint16{dns.TypeTXT}),
+		newUpstreamRoute("mail", newNamedDNSClient("mail", &calls), []string{"example.org.", "example.net."},
+			[]uint16{dns.TypeMX, dns.TypeTXT}),
+	}, newNamedDNSClient("default", &calls))
+
+	tests := []struct {
+		name     string
+		qname    string
+		qtype    uint16
+		expected string
+	}{
+		{name: "Domain", qname: "corp.example.", qtype: dns.TypeA, expected: "corp"},
+		{name: "Subdomain", qname: "host.CORP.example.", qtype: dns.TypeAAAA, expected: "corp"},
+		{name: "FirstMatchingRoute", qname: "host.corp.example.", qtype: dns.TypeTXT, expected: "corp"},
+		{name: "Qtype", qname: "example.com.", qtype: dns.TypeTXT, expected: "txt"},
+		{name: "DomainAndQtype", qname: "example.net.", qtype: dns.TypeMX, expected: "mail"},
+		{name: "DomainWithoutQtype", qname: "example.net.", qtype: dns.TypeA, expected: "default"},
+		{name: "NotSubdomain", qname: "notcorp.example.", qtype: dns.TypeA, expected: "default"},
+		{name: "Default", qname: "example.com.", qtype: dns.TypeA, expected: "default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls = nil
+			_, err := client.Query(context.Background(), newCacheRequest(t, 1, tt.qname, tt.qtype))
+			require.NoError(t, err)
+			require.Equal(t, []string{tt.expected}, calls)
+		})
+	}
+}
+
+func TestRouteDNSClientMetrics(t *testing.T) {
+	var calls []string
+	client := newRouteDNSClient([]*upstreamRoute{
+		newUpstreamRoute("metrics", newNamedDNSClient("metrics", &calls), nil, []uint16{dns.TypeSRV}),
+	}, newNamedDNSClient("default", &calls))
+
+	count := testutil.ToFloat64(RouteCount.WithLabelValues("metrics"))
+	_, err := client.Query(context.Background(), newCacheRequest(t, 1, "example.com.", dns.TypeSRV))
+	require.NoError(t, err)
+	_, err = client.Query(context.Background(), newCacheRequest(t, 1, "example.com.", dns.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, count+1, testutil.ToFloat64(RouteCount.WithLabelValues("metrics")))
+}
+
+func TestRouteDNSClientMalformedRequest(t *testing.T) {
+	var calls []string
+	client := newRouteDNSClient([]*upstreamRoute{
+		newUpstreamRoute("txt", newNamedDNSClient("txt", &calls), nil, []uint16{dns.TypeTXT}),
+	}, newNamedDNSClient("default", &calls))
+
+	_, err := client.Query(context.Background(), []byte("abc"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"default"}, calls)
+}
@@ -2,17 +2,31 @@ package https
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
 	pkgtls "github.com/coredns/coredns/plugin/pkg/tls"
+	"github.com/miekg/dns"
 )
 
-const maxUpstreams = 15
+const (
+	maxUpstreams          = 15
+	defaultUpstreamWeight = 1
+	defaultHedgeMax       = 1
+	defaultReloadInterval = 5 * time.Second
+	// the policy of upstreams with weights if no policy is set
+	defaultWeightedPolicy = "weighted_random"
+)
 
 func init() { plugin.Register("https", setup) }
 
@@ -22,8 +36,58 @@ func setup(c *caddy.Controller) error {
 		return plugin.Error("https", err)
 	}
 
-	dnsClient := setupDNSClient(conf)
-	h := newHTTPS(conf.from, dnsClient, withExcept(conf.except))
+	var bootstrap *bootstrapResolver
+	if len(conf.bootstrap) > 0 {
+		bootstrap = newBootstrapResolver(conf.bootstrap)
+	}
+	tr := newHTTPTransport(conf.transport, conf.tlsConfig, bootstrap)
+	c.OnShutdown(func() error {
+		return closeTransport(tr)
+	})
+
+	fromList, except, err := setupDomainLists(conf, dnsserver.GetConfig(c).Root)
+	if err != nil {
+		return plugin.Error("https", err)
+	}
+
+	dnsClient, checkers := setupDNSClient(conf, tr)
+	views, viewCheckers := setupViews(conf, tr)
+	checkers = append(checkers, viewCheckers...)
+	lists := []*domainList{fromList, except}
+	c.OnStartup(func() error {
+		for _, hc := range checkers {
+			hc.Start()
+		}
+		for _, l := range lists {
+			if l != nil {
+				l.Start()
+			}
+		}
+		if bootstrap != nil {
+			bootstrap.Start()
+		}
+		return nil
+	})
+	c.OnShutdown(func() error {
+		for _, hc := range checkers {
+			hc.Stop()
+		}
+		for _, l := range lists {
+			if l != nil {
+				l.Stop()
+			}
+		}
+		if bootstrap != nil {
+			bootstrap.Stop()
+		}
+		return nil
+	})
+	opts := []httpsOption{withFromList(fromList), withExcept(except), withViews(views),
+		withECS(conf.ecs), withPadding(conf.paddingBlockSize)}
+	if conf.fallthroughOnError {
+		opts = append(opts, withFallthroughOnError(conf.fallthroughRcodes))
+	}
+	h := newHTTPS(conf.from, dnsClient, opts...)
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
 		h.Next = next
 		return h
@@ -32,36 +96,278 @@ func setup(c *caddy.Controller) error {
 	return nil
 }
 
-func setupDNSClient(conf *httpsConfig) dnsClient {
-	tr := &http.Transport{
-		TLSClientConfig:   conf.tlsConfig,
-		ForceAttemptHTTP2: true,
+// setupDomainLists returns the lists of the from and except patterns and files or nil if there are none.
+// Relative paths of the files are resolved against the root directory.
+func setupDomainLists(conf *httpsConfig, root string) (fromList, except *domainList, err error) {
+	interval := conf.reloadInterval
+	if interval == 0 {
+		interval = defaultReloadInterval
+	}
+	if conf.noReload {
+		interval = 0
+	}
+	if len(conf.fromFiles) > 0 {
+		if fromList, err = newDomainList("from", nil, resolvePaths(conf.fromFiles, root), interval); err != nil {
+			return
+		}
+	}
+	if len(conf.except) > 0 || len(conf.exceptFiles) > 0 {
+		except, err = newDomainList("except", conf.except, resolvePaths(conf.exceptFiles, root), interval)
+	}
+	return
+}
+
+func resolvePaths(paths []string, root string) []string {
+	result := make([]string, len(paths))
+	for i, path := range paths {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(root, path)
+		}
+		result[i] = path
 	}
+	return result
+}
+
+func setupDNSClient(conf *httpsConfig, tr http.RoundTripper) (dnsClient, []*healthChecker) {
 	httpClient := &http.Client{
 		Transport: tr,
 	}
 
-	clients := make([]dnsClient, len(conf.toURLs))
-	for i, toURL := range conf.toURLs {
-		clients[i] = newMetricDNSClient(newDoHDNSClient(httpClient, toURL), toURL)
+	lbClient, checkers := setupLoadBalanceDNSClient(conf, httpClient, &upstreamGroup{
+		toURLs:          conf.toURLs,
+		upstreamECS:     conf.upstreamECS,
+		upstreamMethods: conf.upstreamMethods,
+		policy:          conf.policy,
+	})
+	var client dnsClient = lbClient
+	if len(conf.routes) > 0 {
+		routes := make([]*upstreamRoute, len(conf.routes))
+		for i, rc := range conf.routes {
+			routeClient, routeCheckers := setupLoadBalanceDNSClient(conf, httpClient, &rc.upstreamGroup)
+			routes[i] = newUpstreamRoute(rc.name, routeClient, rc.domains, rc.qtypes)
+			checkers = append(checkers, routeCheckers...)
+		}
+		client = newRouteDNSClient(routes, client)
+	}
+
+	// the responses of upstreams that add the Client Subnet option depend on the client subnet
+	upstreamECS := append([]*ecsPolicy(nil), conf.upstreamECS...)
+	for _, rc := range conf.routes {
+		upstreamECS = append(upstreamECS, rc.upstreamECS...)
+	}
+	subnets := newUpstreamSubnets(upstreamECS)
+
+	client = newCoalesceDNSClient(client, withCoalesceUpstreamSubnets(subnets))
+	if conf.cacheSize > 0 {
+		cacheOpts := []cacheDNSClientOption{withCacheUpstreamSubnets(subnets)}
+		if conf.cacheMinTTL > 0 {
+			cacheOpts = append(cacheOpts, withCacheMinTTL(conf.cacheMinTTL))
+		}
+		if conf.cacheMaxTTL > 0 {
+			cacheOpts = append(cacheOpts, withCacheMaxTTL(conf.cacheMaxTTL))
+		}
+		if conf.serveStale > 0 {
+			cacheOpts = append(cacheOpts, withCacheServeStale(conf.serveStale))
+		}
+		if conf.prefetch > 0 {
+			cacheOpts = append(cacheOpts, withCachePrefetch(conf.prefetch, conf.prefetchDuration, conf.prefetchPercentage))
+		}
+		client = newCacheDNSClient(client, conf.cacheSize, cacheOpts...)
+	}
+	return client, checkers
+}
+
+// setupViews returns the views with their own upstreams and the health checkers of the upstreams.
+func setupViews(conf *httpsConfig, tr http.RoundTripper) ([]*clientView, []*healthChecker) {
+	var views []*clientView
+	var checkers []*healthChecker
+	for _, vc := range conf.views {
+		// the rest of the properties are shared with the default upstreams, routes are not
+		viewConf := *conf
+		viewConf.toURLs, viewConf.weights, viewConf.upstreamECS = vc.toURLs, vc.weights, vc.upstreamECS
+		viewConf.upstreamMethods = vc.upstreamMethods
+		viewConf.policy = vc.policy
+		viewConf.routes = nil
+		client, viewCheckers := setupDNSClient(&viewConf, tr)
+		views = append(views, newClientView(vc.nets, client))
+		checkers = append(checkers, viewCheckers...)
+	}
+	return views, checkers
+}
+
+// setupLoadBalanceDNSClient returns the client that load balances queries between the upstreams
+// of the group according to its policy and the health checkers of the upstreams.
+func setupLoadBalanceDNSClient(conf *httpsConfig, httpClient *http.Client, g *upstreamGroup) (*lbDNSClient, []*healthChecker) {
+	toURLs, upstreamECS, p := g.toURLs, g.upstreamECS, g.policy
+	var dohOpts []dohDNSClientOption
+	if conf.method != "" {
+		dohOpts = append(dohOpts, withDoHMethod(conf.method))
+	}
+	if conf.maxGetURLLen > 0 {
+		dohOpts = append(dohOpts, withDoHMaxGetURLLength(conf.maxGetURLLen))
+	}
+	if conf.maxMsgSize > 0 {
+		dohOpts = append(dohOpts, withDoHMaxMessageSize(conf.maxMsgSize))
+	}
+
+	var hcOpts []healthCheckerOption
+	if conf.healthCheckDomain != "" {
+		hcOpts = append(hcOpts, withHealthCheckDomain(conf.healthCheckDomain))
+	}
+	if conf.timeout > 0 {
+		hcOpts = append(hcOpts, withHealthCheckTimeout(conf.timeout))
+	}
+
+	// failed requests are observed by latency aware policies as timed out
+	failurePenalty := conf.timeout
+	if failurePenalty == 0 {
+		failurePenalty = defaultRequestTimeout
 	}
 
-	var opts []lbDNSClientOption
-	if conf.policy != nil {
-		opts = append(opts, withLbPolicy(conf.policy))
+	clients := make([]dnsClient, len(toURLs))
+	var checkers []*healthChecker
+	var health []upstreamHealth
+	var breakers []*circuitBreaker
+	for i, toURL := range toURLs {
+		upstreamDoHOpts := dohOpts
+		if i < len(g.upstreamMethods) && g.upstreamMethods[i] != "" {
+			// the method of the upstream overrides the method property
+			upstreamDoHOpts = append(append([]dohDNSClientOption(nil), dohOpts...), withDoHMethod(g.upstreamMethods[i]))
+		}
+		dohClient := newDoHDNSClient(httpClient, toURL, upstreamDoHOpts...)
+		var upstream dnsClient = dohClient
+		if i < len(upstreamECS) && upstreamECS[i] != nil {
+			upstream = newECSDNSClient(dohClient, upstreamECS[i], conf.paddingBlockSize)
+		}
+		var metricOpts []metricDNSClientOption
+		if observer, ok := p.(latencyObserver); ok {
+			id := i
+			metricOpts = append(metricOpts, withMetricLatencyObserver(func(d time.Duration) {
+				observer.Observe(id, d)
+			}, failurePenalty))
+		}
+		clients[i] = newMetricDNSClient(upstream, toURL, metricOpts...)
+		if conf.healthCheckInterval > 0 {
+			hc := newHealthChecker(dohClient, toURL, conf.healthCheckInterval, hcOpts...)
+			checkers = append(checkers, hc)
+			health = append(health, hc)
+		}
+		if conf.maxFails > 0 {
+			breakers = append(breakers, newCircuitBreaker(toURL, conf.maxFails, conf.failTimeout))
+		}
+	}
+
+	opts := []lbDNSClientOption{withLbNames(toURLs)}
+	if p != nil {
+		opts = append(opts, withLbPolicy(p))
+	}
+	if len(health) > 0 {
+		opts = append(opts, withLbHealth(health))
+	}
+	if len(breakers) > 0 {
+		opts = append(opts, withLbCircuitBreakers(breakers))
+	}
+	if conf.timeout > 0 {
+		opts = append(opts, withLbRequestTimeout(conf.timeout))
+	}
+	if conf.maxAttempts > 0 {
+		opts = append(opts, withLbMaxAttempts(conf.maxAttempts))
+	}
+	if conf.deadline > 0 {
+		opts = append(opts, withLbDeadline(conf.deadline))
+	}
+	if conf.hedgeDelay > 0 {
+		opts = append(opts, withLbHedge(conf.hedgeDelay, conf.hedgeMax))
+	}
+	if conf.race > 0 {
+		opts = append(opts, withLbRace(conf.race))
+	}
+	if len(conf.nextRcodes) > 0 {
+		opts = append(opts, withLbNextRcodes(conf.nextRcodes))
 	}
 
-	// TODO request timeout, max_fail options
-	return newLoadBalanceDNSClient(clients, opts...)
+	return newLoadBalanceDNSClient(clients, opts...), checkers
 }
 
 type httpsConfig struct {
-	from          string
-	toURLs        []string
-	except        []string
-	tlsConfig     *tls.Config
-	tlsServerName string
-	policy        policy
+	from        string
+	toURLs      []string
+	weights     []int
+	upstreamECS []*ecsPolicy
+	// upstreamMethods are the HTTP methods of the upstreams that override method
+	upstreamMethods []string
+	fromFiles       []string
+	except          []string
+	exceptFiles     []string
+	tlsConfig       *tls.Config
+	tlsServerName   string
+	policy          policy
+	method          string
+	maxGetURLLen    int
+	maxMsgSize      int
+	transport       string
+	bootstrap       []string
+
+	paddingBlockSize int
+	ecs              *ecsPolicy
+
+	healthCheckInterval time.Duration
+	healthCheckDomain   string
+
+	maxFails    int
+	failTimeout time.Duration
+
+	timeout     time.Duration
+	maxAttempts int
+	deadline    time.Duration
+
+	hedgeDelay time.Duration
+	hedgeMax   int
+	race       int
+	nextRcodes []int
+
+	cacheSize   int
+	cacheMinTTL time.Duration
+	cacheMaxTTL time.Duration
+	serveStale  time.Duration
+
+	prefetch           int
+	prefetchDuration   time.Duration
+	prefetchPercentage int
+
+	reloadInterval time.Duration
+	noReload       bool
+
+	fallthroughOnError bool
+	fallthroughRcodes  []int
+
+	routes []*routeConfig
+	views  []*viewConfig
+}
+
+// upstreamGroup is the configuration of the upstreams of a route or a view.
+type upstreamGroup struct {
+	toURLs          []string
+	weights         []int
+	upstreamECS     []*ecsPolicy
+	upstreamMethods []string
+	policy          policy
+}
+
+// routeConfig is the configuration of the group of upstreams
+// that serves queries for the given domains and query types.
+type routeConfig struct {
+	upstreamGroup
+	name    string
+	domains []string
+	qtypes  []uint16
+}
+
+// viewConfig is the configuration of the group of upstreams
+// that serves queries of clients from the given networks.
+type viewConfig struct {
+	upstreamGroup
+	nets []*net.IPNet
 }
 
 func parseConfig(c *caddy.Controller) (conf *httpsConfig, err error) {
@@ -81,24 +387,48 @@ func parseConfig(c *caddy.Controller) (conf *httpsConfig, err error) {
 	if len(toURLs) == 0 {
 		return conf, c.ArgErr()
 	}
-	if len(toURLs) > maxUpstreams {
-		return conf, fmt.Errorf("more than %d TOs configured: %d", maxUpstreams, len(toURLs))
+	g, err := parseUpstreams(c, toURLs)
+	if err != nil {
+		return conf, err
 	}
-	conf.toURLs = make([]string, 0, len(toURLs))
-	for _, to := range toURLs {
-		toURL := "https://" + to
-		if _, err := url.ParseRequestURI(toURL); err != nil {
+	conf.toURLs, conf.weights, conf.upstreamECS, conf.upstreamMethods = g.toURLs, g.weights, g.upstreamECS, g.upstreamMethods
+
+	for c.NextBlock() {
+		if err := parseBlock(c, conf); err != nil {
 			return conf, err
 		}
-		conf.toURLs = append(conf.toURLs, toURL)
 	}
 
-	for c.NextBlock() {
-		if err := parseBlock(c, conf); err != nil {
+	if conf.policy == nil && conf.weights != nil {
+		if conf.policy, err = newPolicy(c, defaultWeightedPolicy, conf.toURLs, conf.weights); err != nil {
 			return conf, err
 		}
 	}
 
+	if conf.deadline > 0 {
+		timeout := conf.timeout
+		if timeout == 0 {
+			timeout = defaultRequestTimeout
+		}
+		if conf.deadline < timeout {
+			return conf, fmt.Errorf("deadline %s is less than request timeout %s", conf.deadline, timeout)
+		}
+	}
+
+	if conf.hedgeDelay > 0 && conf.race > 0 {
+		return conf, errors.New("hedge and race can't be used together")
+	}
+
+	if conf.cacheSize == 0 && (conf.cacheMinTTL > 0 || conf.cacheMaxTTL > 0) {
+		return conf, errors.New("cache_ttl requires cache")
+	}
+	if conf.cacheSize == 0 && conf.serveStale > 0 {
+		return conf, errors.New("serve_stale requires cache")
+	}
+	if conf.cacheSize == 0 && conf.prefetch > 0 {
+		return conf, errors.New("prefetch requires cache")
+	}
+
 	if conf.tlsServerName != "" {
 		if conf.tlsConfig == nil {
 			conf.tlsConfig = new(tls.Config)
@@ -109,6 +439,96 @@ func parseConfig(c *caddy.Controller) (conf *httpsConfig, err error) {
 	return conf, nil
 }
 
+// parseUpstreams parses the upstream endpoints with their parameters into the group without a policy.
+// weights, upstreamECS and upstreamMethods are nil if no upstream has these parameters.
+func parseUpstreams(c *caddy.Controller, toURLs []string) (g upstreamGroup, err error) {
+	if len(toURLs) > maxUpstreams {
+		return g, fmt.Errorf("more than %d TOs configured: %d", maxUpstreams, len(toURLs))
+	}
+	urls := make([]string, 0, len(toURLs))
+	weights := make([]int, 0, len(toURLs))
+	hasWeights := false
+	upstreamECS := make([]*ecsPolicy, 0, len(toURLs))
+	hasUpstreamECS := false
+	methods := make([]string, 0, len(toURLs))
+	hasMethods := false
+	for _, to := range toURLs {
+		toURL, params := splitUpstreamParams(to)
+		toURL = "https://" + toURL
+		if _, err = url.ParseRequestURI(toURL); err != nil {
+			return
+		}
+		urls = append(urls, toURL)
+
+		var up upstreamParams
+		if up, err = parseUpstreamParams(c, params); err != nil {
+			return
+		}
+		weights = append(weights, up.weight)
+		hasWeights = hasWeights || up.weight != defaultUpstreamWeight
+		upstreamECS = append(upstreamECS, up.ecs)
+		hasUpstreamECS = hasUpstreamECS || up.ecs != nil
+		methods = append(methods, up.method)
+		hasMethods = hasMethods || up.method != ""
+	}
+	g.toURLs = urls
+	if hasWeights {
+		g.weights = weights
+	}
+	if hasUpstreamECS {
+		g.upstreamECS = upstreamECS
+	}
+	if hasMethods {
+		g.upstreamMethods = methods
+	}
+	return
+}
+
+// splitUpstreamParams splits the upstream into the address and the parameters,
+// for instance: dns.example/dns-query@weight=4
+func splitUpstreamParams(to string) (addr string, params []string) {
+	parts := strings.Split(to, "@")
+	i := len(parts)
+	for i > 1 && strings.Contains(parts[i-1], "=") {
+		i--
+	}
+	return strings.Join(parts[:i], "@"), parts[i:]
+}
+
+// upstreamParams are the parameters of a single upstream.
+type upstreamParams struct {
+	weight int
+	ecs    *ecsPolicy
+	method string
+}
+
+func parseUpstreamParams(c *caddy.Controller, params []string) (up upstreamParams, err error) {
+	up.weight = defaultUpstreamWeight
+	for _, param := range params {
+		name, value, _ := strings.Cut(param, "=")
+		switch name {
+		case "weight":
+			if up.weight, err = strconv.Atoi(value); err != nil {
+				return
+			}
+			if up.weight <= 0 {
+				return up, c.Errf("upstream weight must be positive: %d", up.weight)
+			}
+		case "ecs":
+			if up.ecs, err = parseECSPolicy(c, strings.Split(value, ":")); err != nil {
+				return
+			}
+		case "method":
+			if up.method, err = parseMethodName(c, value); err != nil {
+				return
+			}
+		default:
+			return up, c.Errf("unknown upstream parameter '%s'", name)
+		}
+	}
+	return
+}
+
 func parseBlock(c *caddy.Controller, conf *httpsConfig) (err error) {
 	f, ok := parseBlockMap[c.Val()]
 	if !ok {
@@ -120,10 +540,35 @@ func parseBlock(c *caddy.Controller, conf *httpsConfig) (err error) {
 type parseBlockFunc func(*caddy.Controller, *httpsConfig) error
 
 var parseBlockMap = map[string]parseBlockFunc{
-	"except":         parseExcept,
-	"tls":            parseTLS,
-	"tls_servername": parseTLSServerName,
-	"policy":         parsePolicy,
+	"from_file":            parseFromFile,
+	"except":               parseExcept,
+	"except_file":          parseExceptFile,
+	"reload":               parseReload,
+	"tls":                  parseTLS,
+	"tls_servername":       parseTLSServerName,
+	"policy":               parsePolicy,
+	"method":               parseMethod,
+	"max_msg_size":         parseMaxMsgSize,
+	"padding":              parsePadding,
+	"ecs":                  parseECS,
+	"route":                parseRoute,
+	"fallthrough_on_error": parseFallthroughOnError,
+	"view":                 parseView,
+	"transport":            parseTransport,
+	"bootstrap":            parseBootstrap,
+	"health_check":         parseHealthCheck,
+	"max_fails":            parseMaxFails,
+	"fail_timeout":         parseFailTimeout,
+	"timeout":              parseTimeout,
+	"max_attempts":         parseMaxAttempts,
+	"deadline":             parseDeadline,
+	"hedge":                parseHedge,
+	"race":                 parseRace,
+	"next":                 parseNext,
+	"cache":                parseCache,
+	"cache_ttl":            parseCacheTTL,
+	"serve_stale":          parseServeStale,
+	"prefetch":             parsePrefetch,
 }
 
 func parseExcept(c *caddy.Controller, conf *httpsConfig) (err error) {
@@ -132,14 +577,52 @@ func parseExcept(c *caddy.Controller, conf *httpsConfig) (err error) {
 		return c.ArgErr()
 	}
 	for i := 0; i < len(except); i++ {
-		if except[i], err = parseHost(except[i]); err != nil {
+		if except[i], err = normalizeDomainPattern(except[i]); err != nil {
 			return
 		}
 	}
-	conf.except = except
+	conf.except = append(conf.except, except...)
 	return
 }
 
+func parseFromFile(c *caddy.Controller, conf *httpsConfig) error {
+	paths := c.RemainingArgs()
+	if len(paths) == 0 {
+		return c.ArgErr()
+	}
+	conf.fromFiles = append(conf.fromFiles, paths...)
+	return nil
+}
+
+func parseExceptFile(c *caddy.Controller, conf *httpsConfig) error {
+	paths := c.RemainingArgs()
+	if len(paths) == 0 {
+		return c.ArgErr()
+	}
+	conf.exceptFiles = append(conf.exceptFiles, paths...)
+	return nil
+}
+
+func parseReload(c *caddy.Controller, conf *httpsConfig) error {
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return c.ArgErr()
+	}
+	if args[0] == "off" {
+		conf.noReload = true
+		return nil
+	}
+	d, err := time.ParseDuration(args[0])
+	if err != nil {
+		return err
+	}
+	if d <= 0 {
+		return c.Errf("reload must be positive: %s", args[0])
+	}
+	conf.reloadInterval, conf.noReload = d, false
+	return nil
+}
+
 func parseHost(hostAddr string) (string, error) {
 	hosts := plugin.Host(hostAddr).NormalizeExact()
 	if len(hosts) == 0 {
@@ -167,20 +650,580 @@ func parseTLSServerName(c *caddy.Controller, conf *httpsConfig) error {
 	return nil
 }
 
-func parsePolicy(c *caddy.Controller, conf *httpsConfig) error {
+func parsePolicy(c *caddy.Controller, conf *httpsConfig) (err error) {
 	args := c.RemainingArgs()
 	if len(args) != 1 {
 		return c.ArgErr()
 	}
-	switch args[0] {
+	conf.policy, err = newPolicy(c, args[0], conf.toURLs, conf.weights)
+	return
+}
+
+// newPolicy returns the policy with the given name for the upstreams.
+// Upstream weights are only allowed with weighted policies, so that they are not silently ignored.
+func newPolicy(c *caddy.Controller, name string, toURLs []string, weights []int) (policy, error) {
+	if weights != nil && name != "weighted_random" && name != "weighted_round_robin" {
+		return nil, c.Errf("upstream weights require weighted_random or weighted_round_robin policy, got '%s'", name)
+	}
+	switch name {
 	case "random":
-		conf.policy = newRandomPolicy()
+		return newRandomPolicy(), nil
 	case "round_robin":
-		conf.policy = newRoundRobinPolicy()
+		return newRoundRobinPolicy(), nil
 	case "sequential":
-		conf.policy = newSequentialPolicy()
+		return newSequentialPolicy(), nil
+	case "fastest":
+		return newFastestPolicy(), nil
+	case "p2c":
+		return newP2CPolicy(), nil
+	case "weighted_random":
+		return newWeightedRandomPolicy(weights), nil
+	case "weighted_round_robin":
+		return newWeightedRoundRobinPolicy(weights), nil
+	case "hash_qname":
+		return newHashQnamePolicy(toURLs), nil
+	default:
+		return nil, c.Errf("unknown policy '%s'", name)
+	}
+}
+
+func parseMethod(c *caddy.Controller, conf *httpsConfig) (err error) {
+	args := c.RemainingArgs()
+	if len(args) == 0 || len(args) > 2 {
+		return c.ArgErr()
+	}
+	if conf.method, err = parseMethodName(c, args[0]); err != nil {
+		return
+	}
+	if len(args) == 2 {
+		if conf.method != http.MethodGet {
+			return c.ArgErr()
+		}
+		if conf.maxGetURLLen, err = strconv.Atoi(args[1]); err != nil {
+			return
+		}
+		if conf.maxGetURLLen <= 0 {
+			return c.Errf("max URL length must be positive: %d", conf.maxGetURLLen)
+		}
+	}
+	return
+}
+
+func parseMethodName(c *caddy.Controller, name string) (string, error) {
+	switch name {
+	case "get":
+		return http.MethodGet, nil
+	case "post":
+		return http.MethodPost, nil
+	default:
+		return "", c.Errf("unknown method '%s'", name)
+	}
+}
+
+func parseMaxMsgSize(c *caddy.Controller, conf *httpsConfig) (err error) {
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return c.ArgErr()
+	}
+	if conf.maxMsgSize, err = strconv.Atoi(args[0]); err != nil {
+		return
+	}
+	if conf.maxMsgSize < dns.MinMsgSize || conf.maxMsgSize > dns.MaxMsgSize {
+		return c.Errf("max_msg_size must be in range [%d, %d]: %d", dns.MinMsgSize, dns.MaxMsgSize, conf.maxMsgSize)
+	}
+	return
+}
+
+func parsePadding(c *caddy.Controller, conf *httpsConfig) (err error) {
+	args := c.RemainingArgs()
+	switch {
+	case len(args) == 1 && args[0] == "off":
+		conf.paddingBlockSize = 0
+	case len(args) == 1 && args[0] == "block":
+		conf.paddingBlockSize = defaultPaddingBlockSize
+	case len(args) == 2 && args[0] == "block":
+		if conf.paddingBlockSize, err = strconv.Atoi(args[1]); err != nil {
+			return
+		}
+		if conf.paddingBlockSize <= 0 || conf.paddingBlockSize > dns.MaxMsgSize {
+			return c.Errf("padding block size must be in range [1, %d]: %d", dns.MaxMsgSize, conf.paddingBlockSize)
+		}
+	default:
+		return c.ArgErr()
+	}
+	return
+}
+
+func parseECS(c *caddy.Controller, conf *httpsConfig) (err error) {
+	conf.ecs, err = parseECSPolicy(c, c.RemainingArgs())
+	return
+}
+
+func parseECSPolicy(c *caddy.Controller, args []string) (*ecsPolicy, error) {
+	if len(args) == 0 {
+		return nil, c.ArgErr()
+	}
+	p := &ecsPolicy{mode: args[0]}
+	switch args[0] {
+	case ecsStrip, ecsPassthrough:
+		if len(args) > 1 {
+			return nil, c.ArgErr()
+		}
+	case ecsAdd:
+		if len(args) != 1 && len(args) != 3 {
+			return nil, c.ArgErr()
+		}
+		p.prefix4, p.prefix6 = defaultECSPrefix4, defaultECSPrefix6
+		if len(args) == 3 {
+			prefix4, err := strconv.ParseUint(args[1], 10, 8)
+			if err != nil || prefix4 > net.IPv4len*8 {
+				return nil, c.Errf("invalid ecs IPv4 prefix length '%s'", args[1])
+			}
+			prefix6, err := strconv.ParseUint(args[2], 10, 8)
+			if err != nil || prefix6 > net.IPv6len*8 {
+				return nil, c.Errf("invalid ecs IPv6 prefix length '%s'", args[2])
+			}
+			p.prefix4, p.prefix6 = uint8(prefix4), uint8(prefix6)
+		}
+	default:
+		return nil, c.Errf("unknown ecs mode '%s'", args[0])
+	}
+	return p, nil
+}
+
+func parseRoute(c *caddy.Controller, conf *httpsConfig) (err error) {
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return c.ArgErr()
+	}
+	rc := &routeConfig{name: args[0]}
+	for _, r := range conf.routes {
+		if r.name == rc.name {
+			return c.Errf("duplicate route '%s'", rc.name)
+		}
+	}
+	var policyName string
+	err = parseSubBlock(c, func() (err error) {
+		switch c.Val() {
+		case "domain":
+			rc.domains, err = parseRouteDomains(c)
+		case "qtype":
+			rc.qtypes, err = parseRouteQtypes(c)
+		default:
+			err = parseUpstreamGroupProperty(c, &rc.upstreamGroup, &policyName)
+		}
+		return
+	})
+	if err != nil {
+		return
+	}
+	if len(rc.domains) == 0 && len(rc.qtypes) == 0 {
+		return c.Errf("route '%s' has neither domains nor query types", rc.name)
+	}
+	if err = rc.upstreamGroup.finish(c, policyName); err != nil {
+		return
+	}
+	conf.routes = append(conf.routes, rc)
+	return
+}
+
+func parseFallthroughOnError(c *caddy.Controller, conf *httpsConfig) error {
+	rcodes, err := parseRcodes(c, c.RemainingArgs())
+	if err != nil {
+		return err
+	}
+	conf.fallthroughOnError = true
+	conf.fallthroughRcodes = append(conf.fallthroughRcodes, rcodes...)
+	return nil
+}
+
+func parseRcodes(c *caddy.Controller, args []string) ([]int, error) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+	rcodes := make([]int, len(args))
+	for i, arg := range args {
+		rcode, ok := dns.StringToRcode[strings.ToUpper(arg)]
+		if !ok {
+			return nil, c.Errf("unknown rcode '%s'", arg)
+		}
+		rcodes[i] = rcode
+	}
+	return rcodes, nil
+}
+
+func parseView(c *caddy.Controller, conf *httpsConfig) (err error) {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return c.ArgErr()
+	}
+	vc := &viewConfig{nets: make([]*net.IPNet, len(args))}
+	for i, arg := range args {
+		if vc.nets[i], err = parseCIDR(arg); err != nil {
+			return c.Errf("invalid view network '%s'", arg)
+		}
+	}
+	var policyName string
+	err = parseSubBlock(c, func() error {
+		return parseUpstreamGroupProperty(c, &vc.upstreamGroup, &policyName)
+	})
+	if err != nil {
+		return
+	}
+	if err = vc.upstreamGroup.finish(c, policyName); err != nil {
+		return
+	}
+	conf.views = append(conf.views, vc)
+	return
+}
+
+// parseCIDR parses the network in CIDR notation or a single IP address.
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address '%s'", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(net.IPv4len*8, net.IPv4len*8)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(net.IPv6len*8, net.IPv6len*8)}, nil
+	}
+	_, ipnet, err := net.ParseCIDR(s)
+	return ipnet, err
+}
+
+// parseSubBlock parses the block that follows the arguments of the current property,
+// f is called for each property of the block.
+func parseSubBlock(c *caddy.Controller, f func() error) error {
+	if !c.NextArg() || c.Val() != "{" {
+		return c.ArgErr()
+	}
+	for c.Next() {
+		if c.Val() == "}" {
+			return nil
+		}
+		if err := f(); err != nil {
+			return err
+		}
+	}
+	return c.EOFErr()
+}
+
+// parseUpstreamGroupProperty parses the to and policy properties of the upstream group block.
+// The name of the policy is returned in policyName, as the policy may depend on the upstreams
+// that are listed after it.
+func parseUpstreamGroupProperty(c *caddy.Controller, g *upstreamGroup, policyName *string) (err error) {
+	switch c.Val() {
+	case "to":
+		toURLs := c.RemainingArgs()
+		if len(toURLs) == 0 {
+			return c.ArgErr()
+		}
+		var parsed upstreamGroup
+		if parsed, err = parseUpstreams(c, toURLs); err != nil {
+			return
+		}
+		g.toURLs, g.weights, g.upstreamECS, g.upstreamMethods = parsed.toURLs, parsed.weights, parsed.upstreamECS, parsed.upstreamMethods
+	case "policy":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		*policyName = args[0]
 	default:
-		return c.Errf("unknown policy '%s'", args[0])
+		return c.Errf("unknown property '%s'", c.Val())
+	}
+	return
+}
+
+// finish checks that the group has upstreams and creates its policy.
+func (g *upstreamGroup) finish(c *caddy.Controller, policyName string) (err error) {
+	if len(g.toURLs) == 0 {
+		return c.Errf("no upstreams configured with to")
+	}
+	if policyName == "" && g.weights != nil {
+		policyName = defaultWeightedPolicy
+	}
+	if policyName != "" {
+		g.policy, err = newPolicy(c, policyName, g.toURLs, g.weights)
+	}
+	return
+}
+
+func parseRouteDomains(c *caddy.Controller) ([]string, error) {
+	domains := c.RemainingArgs()
+	if len(domains) == 0 {
+		return nil, c.ArgErr()
+	}
+	for i := range domains {
+		var err error
+		if domains[i], err = parseHost(domains[i]); err != nil {
+			return nil, err
+		}
+	}
+	return domains, nil
+}
+
+func parseRouteQtypes(c *caddy.Controller) ([]uint16, error) {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return nil, c.ArgErr()
+	}
+	qtypes := make([]uint16, len(args))
+	for i, arg := range args {
+		qtype, ok := dns.StringToType[strings.ToUpper(arg)]
+		if !ok {
+			return nil, c.Errf("unknown query type '%s'", arg)
+		}
+		qtypes[i] = qtype
+	}
+	return qtypes, nil
+}
+
+func parseBootstrap(c *caddy.Controller, conf *httpsConfig) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return c.ArgErr()
+	}
+	for _, arg := range args {
+		host, port, err := net.SplitHostPort(arg)
+		if err != nil {
+			host, port = arg, "53"
+		}
+		if net.ParseIP(host) == nil {
+			return c.Errf("bootstrap server '%s' is not an IP address", arg)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+			return c.Errf("bootstrap server '%s' has invalid port", arg)
+		}
+		conf.bootstrap = append(conf.bootstrap, net.JoinHostPort(host, port))
 	}
 	return nil
 }
+
+func parseTransport(c *caddy.Controller, conf *httpsConfig) error {
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return c.ArgErr()
+	}
+	switch args[0] {
+	case transportH2, transportH3, transportAuto:
+		conf.transport = args[0]
+	default:
+		return c.Errf("unknown transport '%s'", args[0])
+	}
+	return nil
+}
+
+func parseHealthCheck(c *caddy.Controller, conf *httpsConfig) (err error) {
+	args := c.RemainingArgs()
+	if len(args) == 0 || len(args) > 2 {
+		return c.ArgErr()
+	}
+	if conf.healthCheckInterval, err = time.ParseDuration(args[0]); err != nil {
+		return
+	}
+	if conf.healthCheckInterval <= 0 {
+		return c.Errf("health_check interval must be positive: %s", args[0])
+	}
+	if len(args) == 2 {
+		conf.healthCheckDomain = dns.Fqdn(args[1])
+		if _, ok := dns.IsDomainName(conf.healthCheckDomain); !ok {
+			return c.Errf("health_check domain '%s' is not a valid domain name", args[1])
+		}
+	}
+	return
+}
+
+func parseMaxFails(c *caddy.Controller, conf *httpsConfig) (err error) {
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return c.ArgErr()
+	}
+	if conf.maxFails, err = strconv.Atoi(args[0]); err != nil {
+		return
+	}
+	if conf.maxFails < 0 {
+		return c.Errf("max_fails can't be negative: %d", conf.maxFails)
+	}
+	return
+}
+
+func parseFailTimeout(c *caddy.Controller, conf *httpsConfig) (err error) {
+	conf.failTimeout, err = parsePositiveDuration(c)
+	return
+}
+
+func parseTimeout(c *caddy.Controller, conf *httpsConfig) (err error) {
+	conf.timeout, err = parsePositiveDuration(c)
+	return
+}
+
+func parseDeadline(c *caddy.Controller, conf *httpsConfig) (err error) {
+	conf.deadline, err = parsePositiveDuration(c)
+	return
+}
+
+func parsePositiveDuration(c *caddy.Controller) (time.Duration, error) {
+	name := c.Val()
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return 0, c.ArgErr()
+	}
+	d, err := time.ParseDuration(args[0])
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, c.Errf("%s must be positive: %s", name, args[0])
+	}
+	return d, nil
+}
+
+func parseMaxAttempts(c *caddy.Controller, conf *httpsConfig) (err error) {
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return c.ArgErr()
+	}
+	if conf.maxAttempts, err = strconv.Atoi(args[0]); err != nil {
+		return
+	}
+	if conf.maxAttempts <= 0 {
+		return c.Errf("max_attempts must be positive: %d", conf.maxAttempts)
+	}
+	return
+}
+
+func parseHedge(c *caddy.Controller, conf *httpsConfig) (err error) {
+	args := c.RemainingArgs()
+	if len(args) == 0 || len(args) > 2 {
+		return c.ArgErr()
+	}
+	if conf.hedgeDelay, err = time.ParseDuration(args[0]); err != nil {
+		return
+	}
+	if conf.hedgeDelay <= 0 {
+		return c.Errf("hedge delay must be positive: %s", args[0])
+	}
+	conf.hedgeMax = defaultHedgeMax
+	if len(args) == 2 {
+		if conf.hedgeMax, err = strconv.Atoi(args[1]); err != nil {
+			return
+		}
+		if conf.hedgeMax <= 0 {
+			return c.Errf("hedge max must be positive: %d", conf.hedgeMax)
+		}
+	}
+	return
+}
+
+func parseNext(c *caddy.Controller, conf *httpsConfig) (err error) {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return c.ArgErr()
+	}
+	rcodes, err := parseRcodes(c, args)
+	if err != nil {
+		return
+	}
+	conf.nextRcodes = append(conf.nextRcodes, rcodes...)
+	return
+}
+
+func parseRace(c *caddy.Controller, conf *httpsConfig) (err error) {
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return c.ArgErr()
+	}
+	if conf.race, err = strconv.Atoi(args[0]); err != nil {
+		return
+	}
+	if conf.race < 2 {
+		return c.Errf("race must be at least 2: %d", conf.race)
+	}
+	return
+}
+
+func parseCache(c *caddy.Controller, conf *httpsConfig) (err error) {
+	args := c.RemainingArgs()
+	if len(args) > 1 {
+		return c.ArgErr()
+	}
+	conf.cacheSize = defaultCacheSize
+	if len(args) == 1 {
+		if conf.cacheSize, err = strconv.Atoi(args[0]); err != nil {
+			return
+		}
+		if conf.cacheSize <= 0 {
+			return c.Errf("cache size must be positive: %d", conf.cacheSize)
+		}
+	}
+	return
+}
+
+func parseCacheTTL(c *caddy.Controller, conf *httpsConfig) (err error) {
+	args := c.RemainingArgs()
+	if len(args) == 0 || len(args) > 2 {
+		return c.ArgErr()
+	}
+	if conf.cacheMinTTL, err = time.ParseDuration(args[0]); err != nil {
+		return
+	}
+	if conf.cacheMinTTL < 0 {
+		return c.Errf("cache_ttl min can't be negative: %s", args[0])
+	}
+	if len(args) == 2 {
+		if conf.cacheMaxTTL, err = time.ParseDuration(args[1]); err != nil {
+			return
+		}
+		if conf.cacheMaxTTL <= 0 {
+			return c.Errf("cache_ttl max must be positive: %s", args[1])
+		}
+	}
+	maxTTL := conf.cacheMaxTTL
+	if maxTTL == 0 {
+		maxTTL = defaultCacheMaxTTL
+	}
+	if conf.cacheMinTTL > maxTTL {
+		return c.Errf("cache_ttl min %s is greater than max %s", conf.cacheMinTTL, maxTTL)
+	}
+	return
+}
+
+func parseServeStale(c *caddy.Controller, conf *httpsConfig) (err error) {
+	conf.serveStale, err = parsePositiveDuration(c)
+	return
+}
+
+func parsePrefetch(c *caddy.Controller, conf *httpsConfig) (err error) {
+	args := c.RemainingArgs()
+	if len(args) == 0 || len(args) > 3 {
+		return c.ArgErr()
+	}
+	if conf.prefetch, err = strconv.Atoi(args[0]); err != nil {
+		return
+	}
+	if conf.prefetch <= 0 {
+		return c.Errf("prefetch amount must be positive: %d", conf.prefetch)
+	}
+	conf.prefetchDuration = defaultPrefetchDuration
+	if len(args) > 1 {
+		if conf.prefetchDuration, err = time.ParseDuration(args[1]); err != nil {
+			return
+		}
+		if conf.prefetchDuration <= 0 {
+			return c.Errf("prefetch duration must be positive: %s", args[1])
+		}
+	}
+	conf.prefetchPercentage = defaultPrefetchPercentage
+	if len(args) > 2 {
+		if conf.prefetchPercentage, err = strconv.Atoi(strings.TrimSuffix(args[2], "%")); err != nil {
+			return
+		}
+		if conf.prefetchPercentage <= 0 || conf.prefetchPercentage > 100 {
+			return c.Errf("prefetch percentage must be in range (0, 100]: %s", args[2])
+		}
+	}
+	return
+}
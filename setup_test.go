@@ -2,10 +2,16 @@ package https
 
 import (
 	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/coredns/caddy"
+	"github.com/miekg/dns"
 	"github.com/stretchr/testify/require"
 )
 
@@ -58,6 +64,88 @@ func TestParseConfig(t *testing.T) {
 				except: []string{"domain1.com.", "domain2.com."},
 			},
 		},
+		{
+			name:  "ExceptPropertyPatterns",
+			input: "https . example.com/dns-query {\nexcept *.Internal.* regex:^ads[0-9]*\\.\n}\n",
+			expectedConfig: &httpsConfig{
+				from:   ".",
+				toURLs: []string{"https://example.com/dns-query"},
+				except: []string{"*.internal.*.", `regex:^ads[0-9]*\.`},
+			},
+		},
+		{
+			name:  "ExceptFileProperty",
+			input: "https . example.com/dns-query {\nexcept_file /etc/coredns/except.txt\nexcept_file a.txt b.txt\n}\n",
+			expectedConfig: &httpsConfig{
+				from:        ".",
+				toURLs:      []string{"https://example.com/dns-query"},
+				exceptFiles: []string{"/etc/coredns/except.txt", "a.txt", "b.txt"},
+			},
+		},
+		{
+			name:  "FromFileProperty",
+			input: "https . example.com/dns-query {\nfrom_file /etc/coredns/from.txt\n}\n",
+			expectedConfig: &httpsConfig{
+				from:      ".",
+				toURLs:    []string{"https://example.com/dns-query"},
+				fromFiles: []string{"/etc/coredns/from.txt"},
+			},
+		},
+		{
+			name:  "ReloadProperty",
+			input: "https . example.com/dns-query {\nreload 30s\n}\n",
+			expectedConfig: &httpsConfig{
+				from:           ".",
+				toURLs:         []string{"https://example.com/dns-query"},
+				reloadInterval: 30 * time.Second,
+			},
+		},
+		{
+			name:  "ReloadPropertyOff",
+			input: "https . example.com/dns-query {\nreload off\n}\n",
+			expectedConfig: &httpsConfig{
+				from:     ".",
+				toURLs:   []string{"https://example.com/dns-query"},
+				noReload: true,
+			},
+		},
+		{
+			name:  "FallthroughOnErrorProperty",
+			input: "https . example.com/dns-query {\nfallthrough_on_error\n}\n",
+			expectedConfig: &httpsConfig{
+				from:               ".",
+				toURLs:             []string{"https://example.com/dns-query"},
+				fallthroughOnError: true,
+			},
+		},
+		{
+			name:  "FallthroughOnErrorPropertyRcodes",
+			input: "https . example.com/dns-query {\nfallthrough_on_error SERVFAIL refused\n}\n",
+			expectedConfig: &httpsConfig{
+				from:               ".",
+				toURLs:             []string{"https://example.com/dns-query"},
+				fallthroughOnError: true,
+				fallthroughRcodes:  []int{dns.RcodeServerFailure, dns.RcodeRefused},
+			},
+		},
+		{
+			name:  "NextProperty",
+			input: "https . example.com/dns-query {\nnext SERVFAIL refused\n}\n",
+			expectedConfig: &httpsConfig{
+				from:       ".",
+				toURLs:     []string{"https://example.com/dns-query"},
+				nextRcodes: []int{dns.RcodeServerFailure, dns.RcodeRefused},
+			},
+		},
+		{
+			name:  "BootstrapProperty",
+			input: "https . example.com/dns-query {\nbootstrap 9.9.9.9 1.1.1.1:5353 2620:fe::fe [2001:db8::1]:53\n}\n",
+			expectedConfig: &httpsConfig{
+				from:      ".",
+				toURLs:    []string{"https://example.com/dns-query"},
+				bootstrap: []string{"9.9.9.9:53", "1.1.1.1:5353", "[2620:fe::fe]:53", "[2001:db8::1]:53"},
+			},
+		},
 		{
 			name:  "TLSServerNameProperty",
 			input: "https . 10.1.1.1:853/dns-query {\ntls_servername internal.domain\n}\n",
@@ -95,6 +183,485 @@ func TestParseConfig(t *testing.T) {
 				policy: newSequentialPolicy(),
 			},
 		},
+		{
+			name:  "PolicyPropertyFastest",
+			input: "https . example.com/dns-query {\npolicy fastest\n}\n",
+			expectedConfig: &httpsConfig{
+				from:   ".",
+				toURLs: []string{"https://example.com/dns-query"},
+				policy: newFastestPolicy(),
+			},
+		},
+		{
+			name:  "PolicyPropertyP2C",
+			input: "https . example.com/dns-query {\npolicy p2c\n}\n",
+			expectedConfig: &httpsConfig{
+				from:   ".",
+				toURLs: []string{"https://example.com/dns-query"},
+				policy: newP2CPolicy(),
+			},
+		},
+		{
+			name:  "PolicyPropertyHashQname",
+			input: "https . example.com/dns-query example.org/dns-query {\npolicy hash_qname\n}\n",
+			expectedConfig: &httpsConfig{
+				from:   ".",
+				toURLs: []string{"https://example.com/dns-query", "https://example.org/dns-query"},
+				policy: newHashQnamePolicy([]string{"https://example.com/dns-query", "https://example.org/dns-query"}),
+			},
+		},
+		{
+			name:  "UpstreamWeights",
+			input: "https . example.com/dns-query@weight=4 example.org/dns-query {\npolicy weighted_random\n}\n",
+			expectedConfig: &httpsConfig{
+				from:    ".",
+				toURLs:  []string{"https://example.com/dns-query", "https://example.org/dns-query"},
+				weights: []int{4, 1},
+				policy:  newWeightedRandomPolicy([]int{4, 1}),
+			},
+		},
+		{
+			name:  "UpstreamWeightsRoundRobin",
+			input: "https . example.com/dns-query example.org/dns-query@weight=3 {\npolicy weighted_round_robin\n}\n",
+			expectedConfig: &httpsConfig{
+				from:    ".",
+				toURLs:  []string{"https://example.com/dns-query", "https://example.org/dns-query"},
+				weights: []int{1, 3},
+				policy:  newWeightedRoundRobinPolicy([]int{1, 3}),
+			},
+		},
+		{
+			name:  "UpstreamDefaultWeights",
+			input: "https . example.com/dns-query@weight=1 {\npolicy weighted_random\n}\n",
+			expectedConfig: &httpsConfig{
+				from:   ".",
+				toURLs: []string{"https://example.com/dns-query"},
+				policy: newWeightedRandomPolicy(nil),
+			},
+		},
+		{
+			name:  "ECSProperty",
+			input: "https . example.com/dns-query {\necs strip\n}\n",
+			expectedConfig: &httpsConfig{
+				from:   ".",
+				toURLs: []string{"https://example.com/dns-query"},
+				ecs:    &ecsPolicy{mode: ecsStrip},
+			},
+		},
+		{
+			name:  "ECSPropertyAdd",
+			input: "https . example.com/dns-query {\necs add\n}\n",
+			expectedConfig: &httpsConfig{
+				from:   ".",
+				toURLs: []string{"https://example.com/dns-query"},
+				ecs:    &ecsPolicy{mode: ecsAdd, prefix4: defaultECSPrefix4, prefix6: defaultECSPrefix6},
+			},
+		},
+		{
+			name:  "ECSPropertyAddPrefixes",
+			input: "https . example.com/dns-query {\necs add 16 48\n}\n",
+			expectedConfig: &httpsConfig{
+				from:   ".",
+				toURLs: []string{"https://example.com/dns-query"},
+				ecs:    &ecsPolicy{mode: ecsAdd, prefix4: 16, prefix6: 48},
+			},
+		},
+		{
+			name:  "UpstreamMethod",
+			input: "https . cdn.example/dns-query@method=get 10.0.0.10/dns-query@method=post {\nmethod get 1024\n}\n",
+			expectedConfig: &httpsConfig{
+				from:            ".",
+				toURLs:          []string{"https://cdn.example/dns-query", "https://10.0.0.10/dns-query"},
+				upstreamMethods: []string{http.MethodGet, http.MethodPost},
+				method:          http.MethodGet,
+				maxGetURLLen:    1024,
+			},
+		},
+		{
+			name:  "UpstreamMethodDefault",
+			input: "https . cdn.example/dns-query@method=get 10.0.0.10/dns-query",
+			expectedConfig: &httpsConfig{
+				from:            ".",
+				toURLs:          []string{"https://cdn.example/dns-query", "https://10.0.0.10/dns-query"},
+				upstreamMethods: []string{http.MethodGet, ""},
+			},
+		},
+		{
+			name:  "UpstreamECS",
+			input: "https . example.com/dns-query geo.example.org/dns-query@ecs=add:16:48 {\necs strip\n}\n",
+			expectedConfig: &httpsConfig{
+				from:        ".",
+				toURLs:      []string{"https://example.com/dns-query", "https://geo.example.org/dns-query"},
+				upstreamECS: []*ecsPolicy{nil, {mode: ecsAdd, prefix4: 16, prefix6: 48}},
+				ecs:         &ecsPolicy{mode: ecsStrip},
+			},
+		},
+		{
+			name: "RouteProperty",
+			input: `https . dns.example/dns-query {
+				route corp {
+					domain corp.example 10.in-addr.arpa
+					to 10.0.0.10/dns-query 10.0.0.11/dns-query@weight=2
+					policy weighted_round_robin
+				}
+				route txt {
+					qtype TXT mx
+					to txt.example/dns-query@ecs=strip
+				}
+				timeout 1s
+			}`,
+			expectedConfig: &httpsConfig{
+				from:    ".",
+				toURLs:  []string{"https://dns.example/dns-query"},
+				timeout: time.Second,
+				routes: []*routeConfig{
+					{
+						name:    "corp",
+						domains: []string{"corp.example.", "10.in-addr.arpa."},
+						upstreamGroup: upstreamGroup{
+							toURLs:  []string{"https://10.0.0.10/dns-query", "https://10.0.0.11/dns-query"},
+							weights: []int{1, 2},
+							policy:  newWeightedRoundRobinPolicy([]int{1, 2}),
+						},
+					},
+					{
+						name:   "txt",
+						qtypes: []uint16{dns.TypeTXT, dns.TypeMX},
+						upstreamGroup: upstreamGroup{
+							toURLs:      []string{"https://txt.example/dns-query"},
+							upstreamECS: []*ecsPolicy{{mode: ecsStrip}},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "RouteWeightsDefaultPolicy",
+			input: `https . dns.example/dns-query {
+				route corp {
+					domain corp.example
+					to 10.0.0.10/dns-query@weight=2 10.0.0.11/dns-query
+				}
+			}`,
+			expectedConfig: &httpsConfig{
+				from:   ".",
+				toURLs: []string{"https://dns.example/dns-query"},
+				routes: []*routeConfig{
+					{
+						name:    "corp",
+						domains: []string{"corp.example."},
+						upstreamGroup: upstreamGroup{
+							toURLs:  []string{"https://10.0.0.10/dns-query", "https://10.0.0.11/dns-query"},
+							weights: []int{2, 1},
+							policy:  newWeightedRandomPolicy([]int{2, 1}),
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "ViewProperty",
+			input: `https . dns.example/dns-query {
+				view 192.168.100.0/24 10.0.0.1 2001:db8::/32 {
+					to filter.example/dns-query filter.example.org/dns-query
+					policy sequential
+				}
+			}`,
+			expectedConfig: &httpsConfig{
+				from:   ".",
+				toURLs: []string{"https://dns.example/dns-query"},
+				views: []*viewConfig{
+					{
+						nets: []*net.IPNet{
+							{IP: net.IPv4(192, 168, 100, 0).To4(), Mask: net.CIDRMask(24, 32)},
+							{IP: net.IPv4(10, 0, 0, 1).To4(), Mask: net.CIDRMask(32, 32)},
+							{IP: net.ParseIP("2001:db8::"), Mask: net.CIDRMask(32, 128)},
+						},
+						upstreamGroup: upstreamGroup{
+							toURLs: []string{"https://filter.example/dns-query", "https://filter.example.org/dns-query"},
+							policy: newSequentialPolicy(),
+						},
+					},
+				},
+			},
+		},
+		{
+			name:  "UpstreamWithUserInfo",
+			input: "https . user@example.com/dns-query@weight=2",
+			expectedConfig: &httpsConfig{
+				from:    ".",
+				toURLs:  []string{"https://user@example.com/dns-query"},
+				weights: []int{2},
+				policy:  newWeightedRandomPolicy([]int{2}),
+			},
+		},
+		{
+			name:  "UpstreamWeightsDefaultPolicy",
+			input: "https . a.example/dns-query@weight=4 b.example/dns-query",
+			expectedConfig: &httpsConfig{
+				from:    ".",
+				toURLs:  []string{"https://a.example/dns-query", "https://b.example/dns-query"},
+				weights: []int{4, 1},
+				policy:  newWeightedRandomPolicy([]int{4, 1}),
+			},
+		},
+		{
+			name:  "MethodPropertyGet",
+			input: "https . example.com/dns-query {\nmethod get\n}\n",
+			expectedConfig: &httpsConfig{
+				from:   ".",
+				toURLs: []string{"https://example.com/dns-query"},
+				method: http.MethodGet,
+			},
+		},
+		{
+			name:  "MethodPropertyGetMaxURLLength",
+			input: "https . example.com/dns-query {\nmethod get 1024\n}\n",
+			expectedConfig: &httpsConfig{
+				from:         ".",
+				toURLs:       []string{"https://example.com/dns-query"},
+				method:       http.MethodGet,
+				maxGetURLLen: 1024,
+			},
+		},
+		{
+			name:  "MethodPropertyPost",
+			input: "https . example.com/dns-query {\nmethod post\n}\n",
+			expectedConfig: &httpsConfig{
+				from:   ".",
+				toURLs: []string{"https://example.com/dns-query"},
+				method: http.MethodPost,
+			},
+		},
+		{
+			name:  "MaxMsgSizeProperty",
+			input: "https . example.com/dns-query {\nmax_msg_size 4096\n}\n",
+			expectedConfig: &httpsConfig{
+				from:       ".",
+				toURLs:     []string{"https://example.com/dns-query"},
+				maxMsgSize: 4096,
+			},
+		},
+		{
+			name:  "PaddingProperty",
+			input: "https . example.com/dns-query {\npadding block\n}\n",
+			expectedConfig: &httpsConfig{
+				from:             ".",
+				toURLs:           []string{"https://example.com/dns-query"},
+				paddingBlockSize: defaultPaddingBlockSize,
+			},
+		},
+		{
+			name:  "PaddingPropertyBlockSize",
+			input: "https . example.com/dns-query {\npadding block 468\n}\n",
+			expectedConfig: &httpsConfig{
+				from:             ".",
+				toURLs:           []string{"https://example.com/dns-query"},
+				paddingBlockSize: 468,
+			},
+		},
+		{
+			name:  "PaddingPropertyOff",
+			input: "https . example.com/dns-query {\npadding block 468\npadding off\n}\n",
+			expectedConfig: &httpsConfig{
+				from:   ".",
+				toURLs: []string{"https://example.com/dns-query"},
+			},
+		},
+		{
+			name:  "TransportPropertyH3",
+			input: "https . example.com/dns-query {\ntransport h3\n}\n",
+			expectedConfig: &httpsConfig{
+				from:      ".",
+				toURLs:    []string{"https://example.com/dns-query"},
+				transport: transportH3,
+			},
+		},
+		{
+			name:  "TransportPropertyAuto",
+			input: "https . example.com/dns-query {\ntransport auto\n}\n",
+			expectedConfig: &httpsConfig{
+				from:      ".",
+				toURLs:    []string{"https://example.com/dns-query"},
+				transport: transportAuto,
+			},
+		},
+		{
+			name:  "HealthCheckProperty",
+			input: "https . example.com/dns-query {\nhealth_check 5s\n}\n",
+			expectedConfig: &httpsConfig{
+				from:                ".",
+				toURLs:              []string{"https://example.com/dns-query"},
+				healthCheckInterval: 5 * time.Second,
+			},
+		},
+		{
+			name:  "HealthCheckPropertyDomain",
+			input: "https . example.com/dns-query {\nhealth_check 5s example.org\n}\n",
+			expectedConfig: &httpsConfig{
+				from:                ".",
+				toURLs:              []string{"https://example.com/dns-query"},
+				healthCheckInterval: 5 * time.Second,
+				healthCheckDomain:   "example.org.",
+			},
+		},
+		{
+			name:  "MaxFailsProperty",
+			input: "https . example.com/dns-query {\nmax_fails 3\n}\n",
+			expectedConfig: &httpsConfig{
+				from:     ".",
+				toURLs:   []string{"https://example.com/dns-query"},
+				maxFails: 3,
+			},
+		},
+		{
+			name:  "FailTimeoutProperty",
+			input: "https . example.com/dns-query {\nmax_fails 3\nfail_timeout 30s\n}\n",
+			expectedConfig: &httpsConfig{
+				from:        ".",
+				toURLs:      []string{"https://example.com/dns-query"},
+				maxFails:    3,
+				failTimeout: 30 * time.Second,
+			},
+		},
+		{
+			name:  "TimeoutProperty",
+			input: "https . example.com/dns-query {\ntimeout 500ms\n}\n",
+			expectedConfig: &httpsConfig{
+				from:    ".",
+				toURLs:  []string{"https://example.com/dns-query"},
+				timeout: 500 * time.Millisecond,
+			},
+		},
+		{
+			name:  "MaxAttemptsProperty",
+			input: "https . example.com/dns-query example.org/dns-query {\nmax_attempts 1\n}\n",
+			expectedConfig: &httpsConfig{
+				from:        ".",
+				toURLs:      []string{"https://example.com/dns-query", "https://example.org/dns-query"},
+				maxAttempts: 1,
+			},
+		},
+		{
+			name:  "DeadlineProperty",
+			input: "https . example.com/dns-query {\ndeadline 5s\n}\n",
+			expectedConfig: &httpsConfig{
+				from:     ".",
+				toURLs:   []string{"https://example.com/dns-query"},
+				deadline: 5 * time.Second,
+			},
+		},
+		{
+			name:  "TimeoutAndDeadlineProperties",
+			input: "https . example.com/dns-query {\ntimeout 1s\ndeadline 1s\n}\n",
+			expectedConfig: &httpsConfig{
+				from:     ".",
+				toURLs:   []string{"https://example.com/dns-query"},
+				timeout:  time.Second,
+				deadline: time.Second,
+			},
+		},
+		{
+			name:  "HedgeProperty",
+			input: "https . example.com/dns-query {\nhedge 100ms\n}\n",
+			expectedConfig: &httpsConfig{
+				from:       ".",
+				toURLs:     []string{"https://example.com/dns-query"},
+				hedgeDelay: 100 * time.Millisecond,
+				hedgeMax:   1,
+			},
+		},
+		{
+			name:  "HedgePropertyMax",
+			input: "https . example.com/dns-query {\nhedge 100ms 2\n}\n",
+			expectedConfig: &httpsConfig{
+				from:       ".",
+				toURLs:     []string{"https://example.com/dns-query"},
+				hedgeDelay: 100 * time.Millisecond,
+				hedgeMax:   2,
+			},
+		},
+		{
+			name:  "RaceProperty",
+			input: "https . example.com/dns-query example.org/dns-query {\nrace 2\n}\n",
+			expectedConfig: &httpsConfig{
+				from:   ".",
+				toURLs: []string{"https://example.com/dns-query", "https://example.org/dns-query"},
+				race:   2,
+			},
+		},
+		{
+			name:  "CacheProperty",
+			input: "https . example.com/dns-query {\ncache\n}\n",
+			expectedConfig: &httpsConfig{
+				from:      ".",
+				toURLs:    []string{"https://example.com/dns-query"},
+				cacheSize: defaultCacheSize,
+			},
+		},
+		{
+			name:  "CachePropertySize",
+			input: "https . example.com/dns-query {\ncache 100\n}\n",
+			expectedConfig: &httpsConfig{
+				from:      ".",
+				toURLs:    []string{"https://example.com/dns-query"},
+				cacheSize: 100,
+			},
+		},
+		{
+			name:  "CacheTTLProperty",
+			input: "https . example.com/dns-query {\ncache\ncache_ttl 10s\n}\n",
+			expectedConfig: &httpsConfig{
+				from:        ".",
+				toURLs:      []string{"https://example.com/dns-query"},
+				cacheSize:   defaultCacheSize,
+				cacheMinTTL: 10 * time.Second,
+			},
+		},
+		{
+			name:  "CacheTTLPropertyMax",
+			input: "https . example.com/dns-query {\ncache\ncache_ttl 0s 5m\n}\n",
+			expectedConfig: &httpsConfig{
+				from:        ".",
+				toURLs:      []string{"https://example.com/dns-query"},
+				cacheSize:   defaultCacheSize,
+				cacheMaxTTL: 5 * time.Minute,
+			},
+		},
+		{
+			name:  "ServeStaleProperty",
+			input: "https . example.com/dns-query {\ncache\nserve_stale 1h\n}\n",
+			expectedConfig: &httpsConfig{
+				from:       ".",
+				toURLs:     []string{"https://example.com/dns-query"},
+				cacheSize:  defaultCacheSize,
+				serveStale: time.Hour,
+			},
+		},
+		{
+			name:  "PrefetchProperty",
+			input: "https . example.com/dns-query {\ncache\nprefetch 10\n}\n",
+			expectedConfig: &httpsConfig{
+				from:               ".",
+				toURLs:             []string{"https://example.com/dns-query"},
+				cacheSize:          defaultCacheSize,
+				prefetch:           10,
+				prefetchDuration:   defaultPrefetchDuration,
+				prefetchPercentage: defaultPrefetchPercentage,
+			},
+		},
+		{
+			name:  "PrefetchPropertyAllArgs",
+			input: "https . example.com/dns-query {\ncache\nprefetch 5 10m 20%\n}\n",
+			expectedConfig: &httpsConfig{
+				from:               ".",
+				toURLs:             []string{"https://example.com/dns-query"},
+				cacheSize:          defaultCacheSize,
+				prefetch:           5,
+				prefetchDuration:   10 * time.Minute,
+				prefetchPercentage: 20,
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -141,6 +708,132 @@ func TestParseConfigError(t *testing.T) {
 			name:  "TooManyToURLs",
 			input: "https . " + strings.Repeat("example.com/dns-query ", maxUpstreams+1),
 		},
+		{
+			name:  "UpstreamUnknownParam",
+			input: "https . example.com/dns-query@abc=1",
+		},
+		{
+			name:  "UpstreamUnknownMethod",
+			input: "https . example.com/dns-query@method=put",
+		},
+		{
+			name:  "UpstreamWeightsNonWeightedPolicy",
+			input: "https . a.example/dns-query@weight=4 b.example/dns-query {\npolicy round_robin\n}\n",
+		},
+		{
+			name: "RouteWeightsNonWeightedPolicy",
+			input: `https . dns.example/dns-query {
+				route corp {
+					domain corp.example
+					to 10.0.0.10/dns-query@weight=2 10.0.0.11/dns-query
+					policy sequential
+				}
+			}`,
+		},
+		{
+			name:  "UpstreamInvalidWeight",
+			input: "https . example.com/dns-query@weight=abc",
+		},
+		{
+			name:  "UpstreamZeroWeight",
+			input: "https . example.com/dns-query@weight=0",
+		},
+		{
+			name:  "UpstreamUnknownECSMode",
+			input: "https . example.com/dns-query@ecs=abc",
+		},
+		{
+			name:  "UpstreamInvalidECSPrefix",
+			input: "https . example.com/dns-query@ecs=add:33:56",
+		},
+		{
+			name:  "ECSPropertyNoArgs",
+			input: "https . example.com/dns-query {\necs\n}\n",
+		},
+		{
+			name:  "ECSPropertyUnknownMode",
+			input: "https . example.com/dns-query {\necs abc\n}\n",
+		},
+		{
+			name:  "ECSPropertyStripTooManyArgs",
+			input: "https . example.com/dns-query {\necs strip 24\n}\n",
+		},
+		{
+			name:  "ECSPropertyAddOnePrefix",
+			input: "https . example.com/dns-query {\necs add 24\n}\n",
+		},
+		{
+			name:  "ECSPropertyAddInvalidPrefix4",
+			input: "https . example.com/dns-query {\necs add abc 56\n}\n",
+		},
+		{
+			name:  "ECSPropertyAddInvalidPrefix6",
+			input: "https . example.com/dns-query {\necs add 24 129\n}\n",
+		},
+		{
+			name:  "RoutePropertyNoName",
+			input: "https . example.com/dns-query {\nroute {\nto a.example/dns-query\nqtype TXT\n}\n}\n",
+		},
+		{
+			name:  "RoutePropertyNoBlock",
+			input: "https . example.com/dns-query {\nroute txt\n}\n",
+		},
+		{
+			name:  "RoutePropertyUnknownProperty",
+			input: "https . example.com/dns-query {\nroute txt {\nto a.example/dns-query\nqtype TXT\nabc\n}\n}\n",
+		},
+		{
+			name:  "RoutePropertyNoUpstreams",
+			input: "https . example.com/dns-query {\nroute txt {\nqtype TXT\n}\n}\n",
+		},
+		{
+			name:  "RoutePropertyNoMatchers",
+			input: "https . example.com/dns-query {\nroute txt {\nto a.example/dns-query\n}\n}\n",
+		},
+		{
+			name:  "RoutePropertyUnknownQtype",
+			input: "https . example.com/dns-query {\nroute txt {\nto a.example/dns-query\nqtype ABC\n}\n}\n",
+		},
+		{
+			name:  "RoutePropertyEmptyDomain",
+			input: "https . example.com/dns-query {\nroute txt {\nto a.example/dns-query\ndomain\n}\n}\n",
+		},
+		{
+			name:  "RoutePropertyInvalidUpstream",
+			input: "https . example.com/dns-query {\nroute txt {\nto a.example/dns-query@weight=0\nqtype TXT\n}\n}\n",
+		},
+		{
+			name:  "RoutePropertyUnknownPolicy",
+			input: "https . example.com/dns-query {\nroute txt {\nto a.example/dns-query\nqtype TXT\npolicy abc\n}\n}\n",
+		},
+		{
+			name:  "RoutePropertyDuplicateName",
+			input: "https . example.com/dns-query {\nroute txt {\nto a.example/dns-query\nqtype TXT\n}\nroute txt {\nto b.example/dns-query\nqtype MX\n}\n}\n",
+		},
+		{
+			name:  "ViewPropertyNoNetworks",
+			input: "https . example.com/dns-query {\nview {\nto a.example/dns-query\n}\n}\n",
+		},
+		{
+			name:  "ViewPropertyInvalidNetwork",
+			input: "https . example.com/dns-query {\nview 10.0.0.0/33 {\nto a.example/dns-query\n}\n}\n",
+		},
+		{
+			name:  "ViewPropertyInvalidAddress",
+			input: "https . example.com/dns-query {\nview abc {\nto a.example/dns-query\n}\n}\n",
+		},
+		{
+			name:  "ViewPropertyNoBlock",
+			input: "https . example.com/dns-query {\nview 10.0.0.0/8\n}\n",
+		},
+		{
+			name:  "ViewPropertyNoUpstreams",
+			input: "https . example.com/dns-query {\nview 10.0.0.0/8 {\npolicy sequential\n}\n}\n",
+		},
+		{
+			name:  "ViewPropertyUnknownProperty",
+			input: "https . example.com/dns-query {\nview 10.0.0.0/8 {\nto a.example/dns-query\nqtype TXT\n}\n}\n",
+		},
 		{
 			name:  "UnknownProperty",
 			input: "https . example.com/dns-query {\nabc\n}\n",
@@ -149,6 +842,58 @@ func TestParseConfigError(t *testing.T) {
 			name:  "ExceptPropertyZeroArgs",
 			input: "https . example.com/dns-query {\nexcept\n}\n",
 		},
+		{
+			name:  "ExceptPropertyInvalidRegex",
+			input: "https . example.com/dns-query {\nexcept regex:(\n}\n",
+		},
+		{
+			name:  "ExceptPropertyInvalidWildcard",
+			input: "https . example.com/dns-query {\nexcept *..example.com\n}\n",
+		},
+		{
+			name:  "ExceptFilePropertyZeroArgs",
+			input: "https . example.com/dns-query {\nexcept_file\n}\n",
+		},
+		{
+			name:  "FromFilePropertyZeroArgs",
+			input: "https . example.com/dns-query {\nfrom_file\n}\n",
+		},
+		{
+			name:  "ReloadPropertyZeroArgs",
+			input: "https . example.com/dns-query {\nreload\n}\n",
+		},
+		{
+			name:  "ReloadPropertyInvalidDuration",
+			input: "https . example.com/dns-query {\nreload abc\n}\n",
+		},
+		{
+			name:  "ReloadPropertyZeroDuration",
+			input: "https . example.com/dns-query {\nreload 0s\n}\n",
+		},
+		{
+			name:  "FallthroughOnErrorPropertyUnknownRcode",
+			input: "https . example.com/dns-query {\nfallthrough_on_error SERVFAIL abc\n}\n",
+		},
+		{
+			name:  "NextPropertyZeroArgs",
+			input: "https . example.com/dns-query {\nnext\n}\n",
+		},
+		{
+			name:  "NextPropertyUnknownRcode",
+			input: "https . example.com/dns-query {\nnext SERVFAIL abc\n}\n",
+		},
+		{
+			name:  "BootstrapPropertyZeroArgs",
+			input: "https . example.com/dns-query {\nbootstrap\n}\n",
+		},
+		{
+			name:  "BootstrapPropertyHostname",
+			input: "https . example.com/dns-query {\nbootstrap dns.quad9.net\n}\n",
+		},
+		{
+			name:  "BootstrapPropertyInvalidPort",
+			input: "https . example.com/dns-query {\nbootstrap 9.9.9.9:abc\n}\n",
+		},
 		{
 			name:  "TLSPropertyTooManyArgs",
 			input: "https . example.com/dns-query {\ntls abc def ghi qwe\n}\n",
@@ -173,6 +918,278 @@ func TestParseConfigError(t *testing.T) {
 			name:  "PolicyPropertyUnknownArg",
 			input: "https . example.com/dns-query {\npolicy abc\n}\n",
 		},
+		{
+			name:  "MethodPropertyZeroArgs",
+			input: "https . example.com/dns-query {\nmethod\n}\n",
+		},
+		{
+			name:  "MethodPropertyUnknownArg",
+			input: "https . example.com/dns-query {\nmethod put\n}\n",
+		},
+		{
+			name:  "MethodPropertyPostMaxURLLength",
+			input: "https . example.com/dns-query {\nmethod post 1024\n}\n",
+		},
+		{
+			name:  "MethodPropertyInvalidMaxURLLength",
+			input: "https . example.com/dns-query {\nmethod get abc\n}\n",
+		},
+		{
+			name:  "MethodPropertyNegativeMaxURLLength",
+			input: "https . example.com/dns-query {\nmethod get -1\n}\n",
+		},
+		{
+			name:  "MethodPropertyTooManyArgs",
+			input: "https . example.com/dns-query {\nmethod get 1024 2048\n}\n",
+		},
+		{
+			name:  "MaxMsgSizePropertyNoArgs",
+			input: "https . example.com/dns-query {\nmax_msg_size\n}\n",
+		},
+		{
+			name:  "MaxMsgSizePropertyInvalidArg",
+			input: "https . example.com/dns-query {\nmax_msg_size abc\n}\n",
+		},
+		{
+			name:  "MaxMsgSizePropertyTooSmall",
+			input: "https . example.com/dns-query {\nmax_msg_size 511\n}\n",
+		},
+		{
+			name:  "MaxMsgSizePropertyTooLarge",
+			input: "https . example.com/dns-query {\nmax_msg_size 65536\n}\n",
+		},
+		{
+			name:  "PaddingPropertyNoArgs",
+			input: "https . example.com/dns-query {\npadding\n}\n",
+		},
+		{
+			name:  "PaddingPropertyUnknownArg",
+			input: "https . example.com/dns-query {\npadding random\n}\n",
+		},
+		{
+			name:  "PaddingPropertyInvalidBlockSize",
+			input: "https . example.com/dns-query {\npadding block abc\n}\n",
+		},
+		{
+			name:  "PaddingPropertyZeroBlockSize",
+			input: "https . example.com/dns-query {\npadding block 0\n}\n",
+		},
+		{
+			name:  "PaddingPropertyOffTooManyArgs",
+			input: "https . example.com/dns-query {\npadding off 128\n}\n",
+		},
+		{
+			name:  "TransportPropertyZeroArgs",
+			input: "https . example.com/dns-query {\ntransport\n}\n",
+		},
+		{
+			name:  "TransportPropertyUnknownArg",
+			input: "https . example.com/dns-query {\ntransport quic\n}\n",
+		},
+		{
+			name:  "TransportPropertyTooManyArgs",
+			input: "https . example.com/dns-query {\ntransport h2 h3\n}\n",
+		},
+		{
+			name:  "HealthCheckPropertyZeroArgs",
+			input: "https . example.com/dns-query {\nhealth_check\n}\n",
+		},
+		{
+			name:  "HealthCheckPropertyInvalidInterval",
+			input: "https . example.com/dns-query {\nhealth_check abc\n}\n",
+		},
+		{
+			name:  "HealthCheckPropertyZeroInterval",
+			input: "https . example.com/dns-query {\nhealth_check 0s\n}\n",
+		},
+		{
+			name:  "HealthCheckPropertyInvalidDomain",
+			input: "https . example.com/dns-query {\nhealth_check 5s a..b\n}\n",
+		},
+		{
+			name:  "HealthCheckPropertyTooManyArgs",
+			input: "https . example.com/dns-query {\nhealth_check 5s example.org example.com\n}\n",
+		},
+		{
+			name:  "MaxFailsPropertyZeroArgs",
+			input: "https . example.com/dns-query {\nmax_fails\n}\n",
+		},
+		{
+			name:  "MaxFailsPropertyInvalidArg",
+			input: "https . example.com/dns-query {\nmax_fails abc\n}\n",
+		},
+		{
+			name:  "MaxFailsPropertyNegative",
+			input: "https . example.com/dns-query {\nmax_fails -1\n}\n",
+		},
+		{
+			name:  "FailTimeoutPropertyZeroArgs",
+			input: "https . example.com/dns-query {\nfail_timeout\n}\n",
+		},
+		{
+			name:  "FailTimeoutPropertyInvalidArg",
+			input: "https . example.com/dns-query {\nfail_timeout abc\n}\n",
+		},
+		{
+			name:  "FailTimeoutPropertyZero",
+			input: "https . example.com/dns-query {\nfail_timeout 0s\n}\n",
+		},
+		{
+			name:  "TimeoutPropertyZeroArgs",
+			input: "https . example.com/dns-query {\ntimeout\n}\n",
+		},
+		{
+			name:  "TimeoutPropertyInvalidArg",
+			input: "https . example.com/dns-query {\ntimeout abc\n}\n",
+		},
+		{
+			name:  "TimeoutPropertyNegative",
+			input: "https . example.com/dns-query {\ntimeout -1s\n}\n",
+		},
+		{
+			name:  "TimeoutPropertyTooManyArgs",
+			input: "https . example.com/dns-query {\ntimeout 1s 2s\n}\n",
+		},
+		{
+			name:  "MaxAttemptsPropertyZeroArgs",
+			input: "https . example.com/dns-query {\nmax_attempts\n}\n",
+		},
+		{
+			name:  "MaxAttemptsPropertyInvalidArg",
+			input: "https . example.com/dns-query {\nmax_attempts abc\n}\n",
+		},
+		{
+			name:  "MaxAttemptsPropertyZero",
+			input: "https . example.com/dns-query {\nmax_attempts 0\n}\n",
+		},
+		{
+			name:  "DeadlinePropertyZeroArgs",
+			input: "https . example.com/dns-query {\ndeadline\n}\n",
+		},
+		{
+			name:  "DeadlinePropertyZero",
+			input: "https . example.com/dns-query {\ndeadline 0s\n}\n",
+		},
+		{
+			name:  "DeadlineLessThanDefaultTimeout",
+			input: "https . example.com/dns-query {\ndeadline 1s\n}\n",
+		},
+		{
+			name:  "DeadlineLessThanTimeout",
+			input: "https . example.com/dns-query {\ntimeout 3s\ndeadline 2s\n}\n",
+		},
+		{
+			name:  "HedgePropertyZeroArgs",
+			input: "https . example.com/dns-query {\nhedge\n}\n",
+		},
+		{
+			name:  "HedgePropertyInvalidDelay",
+			input: "https . example.com/dns-query {\nhedge abc\n}\n",
+		},
+		{
+			name:  "HedgePropertyZeroDelay",
+			input: "https . example.com/dns-query {\nhedge 0s\n}\n",
+		},
+		{
+			name:  "HedgePropertyInvalidMax",
+			input: "https . example.com/dns-query {\nhedge 100ms abc\n}\n",
+		},
+		{
+			name:  "HedgePropertyZeroMax",
+			input: "https . example.com/dns-query {\nhedge 100ms 0\n}\n",
+		},
+		{
+			name:  "HedgePropertyTooManyArgs",
+			input: "https . example.com/dns-query {\nhedge 100ms 1 2\n}\n",
+		},
+		{
+			name:  "RacePropertyZeroArgs",
+			input: "https . example.com/dns-query {\nrace\n}\n",
+		},
+		{
+			name:  "RacePropertyInvalidArg",
+			input: "https . example.com/dns-query {\nrace abc\n}\n",
+		},
+		{
+			name:  "RacePropertyOne",
+			input: "https . example.com/dns-query {\nrace 1\n}\n",
+		},
+		{
+			name:  "RaceAndHedgeProperties",
+			input: "https . example.com/dns-query {\nrace 2\nhedge 100ms\n}\n",
+		},
+		{
+			name:  "CachePropertyInvalidArg",
+			input: "https . example.com/dns-query {\ncache abc\n}\n",
+		},
+		{
+			name:  "CachePropertyZero",
+			input: "https . example.com/dns-query {\ncache 0\n}\n",
+		},
+		{
+			name:  "CachePropertyTooManyArgs",
+			input: "https . example.com/dns-query {\ncache 1 2\n}\n",
+		},
+		{
+			name:  "CacheTTLPropertyNoArgs",
+			input: "https . example.com/dns-query {\ncache\ncache_ttl\n}\n",
+		},
+		{
+			name:  "CacheTTLPropertyInvalidArg",
+			input: "https . example.com/dns-query {\ncache\ncache_ttl abc\n}\n",
+		},
+		{
+			name:  "CacheTTLPropertyNegative",
+			input: "https . example.com/dns-query {\ncache\ncache_ttl -1s\n}\n",
+		},
+		{
+			name:  "CacheTTLPropertyMinGreaterThanMax",
+			input: "https . example.com/dns-query {\ncache\ncache_ttl 10m 5m\n}\n",
+		},
+		{
+			name:  "CacheTTLPropertyWithoutCache",
+			input: "https . example.com/dns-query {\ncache_ttl 10s\n}\n",
+		},
+		{
+			name:  "ServeStalePropertyNoArgs",
+			input: "https . example.com/dns-query {\ncache\nserve_stale\n}\n",
+		},
+		{
+			name:  "ServeStalePropertyInvalidArg",
+			input: "https . example.com/dns-query {\ncache\nserve_stale abc\n}\n",
+		},
+		{
+			name:  "ServeStalePropertyZero",
+			input: "https . example.com/dns-query {\ncache\nserve_stale 0s\n}\n",
+		},
+		{
+			name:  "ServeStalePropertyWithoutCache",
+			input: "https . example.com/dns-query {\nserve_stale 1h\n}\n",
+		},
+		{
+			name:  "PrefetchPropertyNoArgs",
+			input: "https . example.com/dns-query {\ncache\nprefetch\n}\n",
+		},
+		{
+			name:  "PrefetchPropertyTooManyArgs",
+			input: "https . example.com/dns-query {\ncache\nprefetch 5 10m 20% 1\n}\n",
+		},
+		{
+			name:  "PrefetchPropertyInvalidAmount",
+			input: "https . example.com/dns-query {\ncache\nprefetch 0\n}\n",
+		},
+		{
+			name:  "PrefetchPropertyInvalidDuration",
+			input: "https . example.com/dns-query {\ncache\nprefetch 5 abc\n}\n",
+		},
+		{
+			name:  "PrefetchPropertyInvalidPercentage",
+			input: "https . example.com/dns-query {\ncache\nprefetch 5 1m 101%\n}\n",
+		},
+		{
+			name:  "PrefetchPropertyWithoutCache",
+			input: "https . example.com/dns-query {\nprefetch 5\n}\n",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -182,3 +1199,51 @@ func TestParseConfigError(t *testing.T) {
 		})
 	}
 }
+
+func TestSetupLoadBalanceDNSClientUpstreamMethods(t *testing.T) {
+	conf := &httpsConfig{method: http.MethodPost}
+	lbClient, _ := setupLoadBalanceDNSClient(conf, http.DefaultClient, &upstreamGroup{
+		toURLs:          []string{"https://cdn.example/dns-query", "https://10.0.0.10/dns-query"},
+		upstreamMethods: []string{http.MethodGet, ""},
+	})
+
+	methods := make([]string, len(lbClient.clients))
+	for i, client := range lbClient.clients {
+		methods[i] = client.(*metricDNSClient).client.(*dohDNSClient).method
+	}
+	require.Equal(t, []string{http.MethodGet, http.MethodPost}, methods)
+}
+
+func TestSetupDomainLists(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "except.txt"), []byte("*.internal.*\nexample.net\n"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "from.txt"), []byte("example.com\n"), 0o600))
+
+	fromList, except, err := setupDomainLists(&httpsConfig{
+		fromFiles:   []string{"from.txt"},
+		except:      []string{"example.org."},
+		exceptFiles: []string{"except.txt"},
+	}, root)
+	require.NoError(t, err)
+	require.Equal(t, defaultReloadInterval, except.interval)
+	require.True(t, fromList.Match("www.example.com."))
+	require.False(t, fromList.Match("example.org."))
+	require.True(t, except.Match("www.example.org."))
+	require.True(t, except.Match("www.example.net."))
+	require.True(t, except.Match("host.internal.corp."))
+	require.False(t, except.Match("example.com."))
+
+	fromList, except, err = setupDomainLists(&httpsConfig{}, root)
+	require.NoError(t, err)
+	require.Nil(t, fromList)
+	require.Nil(t, except)
+
+	_, except, err = setupDomainLists(&httpsConfig{except: []string{"example.org."}, noReload: true}, root)
+	require.NoError(t, err)
+	require.Zero(t, except.interval)
+
+	_, _, err = setupDomainLists(&httpsConfig{exceptFiles: []string{"missing.txt"}}, root)
+	require.Error(t, err)
+	_, _, err = setupDomainLists(&httpsConfig{fromFiles: []string{"missing.txt"}}, root)
+	require.Error(t, err)
+}
@@ -0,0 +1,257 @@
+package https
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+const (
+	transportH2   = "h2"
+	transportH3   = "h3"
+	transportAuto = "auto"
+
+	// RFC7838 Section 3: the default freshness lifetime of the alternative service is 24 hours.
+	defaultAltSvcMaxAge = 24 * time.Hour
+	// how long HTTP/3 is not attempted after the alternative service failed.
+	altSvcBrokenTimeout = 5 * time.Minute
+)
+
+var (
+	errAltSvcRequestBody = errors.New("request body can not be replayed")
+	errNoAltSvc          = errors.New("no alternative service")
+)
+
+type quicDialFunc func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error)
+
+// newHTTPTransport creates a new HTTP round tripper for the given transport name:
+// h2 uses TCP (HTTP/2 with HTTP/1.1 fallback), h3 uses QUIC, auto uses TCP and upgrades
+// to QUIC when the upstream advertises HTTP/3 support via Alt-Svc header.
+// Upstream hostnames are resolved with the bootstrap resolver, if any, instead of the system resolver.
+func newHTTPTransport(transport string, tlsConfig *tls.Config, bootstrap *bootstrapResolver) http.RoundTripper {
+	switch transport {
+	case transportH3:
+		return newH3Transport(tlsConfig, bootstrap)
+	case transportAuto:
+		h3 := newH3Transport(tlsConfig, bootstrap)
+		tr := newAltSvcRoundTripper(newH2Transport(tlsConfig, bootstrap), h3)
+		h3.Dial = tr.dialAlt(h3.Dial)
+		return tr
+	default:
+		return newH2Transport(tlsConfig, bootstrap)
+	}
+}
+
+// closeTransport closes the connections of the round tripper.
+func closeTransport(tr http.RoundTripper) error {
+	if c, ok := tr.(io.Closer); ok {
+		return c.Close()
+	}
+	if c, ok := tr.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+	return nil
+}
+
+func newH2Transport(tlsConfig *tls.Config, bootstrap *bootstrapResolver) *http.Transport {
+	tr := &http.Transport{
+		TLSClientConfig:   tlsConfig,
+		ForceAttemptHTTP2: true,
+	}
+	if bootstrap != nil {
+		tr.DialContext = bootstrap.DialContext
+	}
+	return tr
+}
+
+func newH3Transport(tlsConfig *tls.Config, bootstrap *bootstrapResolver) *http3.RoundTripper {
+	tr := &http3.RoundTripper{
+		TLSClientConfig: tlsConfig,
+	}
+	if bootstrap != nil {
+		tr.Dial = bootstrap.DialQUIC
+	}
+	return tr
+}
+
+// altSvcRoundTripper is a round tripper that sends requests over HTTP/2 until an upstream
+// advertises HTTP/3 support with Alt-Svc header (RFC7838), subsequent requests are sent over HTTP/3.
+// If an HTTP/3 request fails, the request is retried over HTTP/2 and HTTP/3 is not used for this
+// upstream for some time.
+type altSvcRoundTripper struct {
+	h2 http.RoundTripper
+	h3 http.RoundTripper
+
+	mu sync.RWMutex
+	// HTTP/3 alternative services by origin authority (host:port), see originAuthority
+	alts map[string]*altSvc
+}
+
+type altSvc struct {
+	authority string
+	expires   time.Time
+	broken    bool
+}
+
+func newAltSvcRoundTripper(h2, h3 http.RoundTripper) *altSvcRoundTripper {
+	return &altSvcRoundTripper{h2: h2, h3: h3, alts: make(map[string]*altSvc)}
+}
+
+func (t *altSvcRoundTripper) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	origin := originAuthority(req.URL)
+	if alt := t.lookup(origin); alt != "" {
+		if resp, err = t.roundTripH3(req); err == nil {
+			return
+		}
+		t.markBroken(origin)
+	}
+
+	if resp, err = t.h2.RoundTrip(req); err != nil {
+		return
+	}
+	t.update(origin, resp.Header.Get("Alt-Svc"))
+	return
+}
+
+func (t *altSvcRoundTripper) Close() error {
+	err := closeTransport(t.h2)
+	if err3 := closeTransport(t.h3); err == nil {
+		err = err3
+	}
+	return err
+}
+
+// roundTripH3 sends the request to the HTTP/3 round tripper, the QUIC connection of which
+// is established with the alternative service, see dialAlt.
+func (t *altSvcRoundTripper) roundTripH3(req *http.Request) (*http.Response, error) {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return nil, errAltSvcRequestBody
+	}
+	h3req := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		h3req.Body = body
+	}
+	return t.h3.RoundTrip(h3req)
+}
+
+// dialAlt returns the QUIC dial function that connects to the alternative service of the origin
+// with the given dial function or quic.DialAddrEarly if it is nil.
+// RFC7838 Section 2.4: the origin of the request remains the same, only the network location of the connection
+// changes. So the TLS server name is still the origin host, and the alternative service must present
+// a certificate valid for the origin (Section 2.1).
+func (t *altSvcRoundTripper) dialAlt(dial quicDialFunc) quicDialFunc {
+	if dial == nil {
+		dial = quic.DialAddrEarly
+	}
+	return func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+		alt := t.lookup(addr)
+		if alt == "" {
+			return nil, errNoAltSvc
+		}
+		return dial(ctx, alt, tlsCfg, cfg)
+	}
+}
+
+func (t *altSvcRoundTripper) lookup(origin string) string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	alt, ok := t.alts[origin]
+	if !ok || alt.broken || time.Now().After(alt.expires) {
+		return ""
+	}
+	return alt.authority
+}
+
+func (t *altSvcRoundTripper) markBroken(origin string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if alt, ok := t.alts[origin]; ok {
+		alt.broken = true
+		alt.expires = time.Now().Add(altSvcBrokenTimeout)
+	}
+}
+
+func (t *altSvcRoundTripper) update(origin, header string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if alt, ok := t.alts[origin]; ok && alt.broken && time.Now().Before(alt.expires) {
+		return
+	}
+	if header == "" {
+		return
+	}
+	if strings.TrimSpace(header) == "clear" {
+		delete(t.alts, origin)
+		return
+	}
+	authority, maxAge, ok := parseAltSvcH3(header)
+	if !ok {
+		return
+	}
+	host, port, err := net.SplitHostPort(authority)
+	if err != nil {
+		return
+	}
+	if host == "" {
+		// the alternative service is on the same host as the origin
+		if host, _, err = net.SplitHostPort(origin); err != nil {
+			return
+		}
+	}
+	t.alts[origin] = &altSvc{
+		authority: net.JoinHostPort(host, port),
+		expires:   time.Now().Add(maxAge),
+	}
+}
+
+// originAuthority returns the host:port of the URL with the default port of its scheme,
+// the same way the HTTP/3 round tripper addresses the origin.
+func originAuthority(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "443"
+	if u.Scheme == "http" {
+		port = "80"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// parseAltSvcH3 returns the authority and the freshness lifetime of the first HTTP/3
+// alternative service in the Alt-Svc header value, for instance: h3=":443"; ma=86400, h2=":443"
+func parseAltSvcH3(header string) (authority string, maxAge time.Duration, ok bool) {
+	for _, value := range strings.Split(header, ",") {
+		params := strings.Split(value, ";")
+		protocol, alt, found := strings.Cut(strings.TrimSpace(params[0]), "=")
+		if !found || protocol != "h3" {
+			continue
+		}
+		maxAge = defaultAltSvcMaxAge
+		for _, param := range params[1:] {
+			name, val, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if name != "ma" {
+				continue
+			}
+			if seconds, err := strconv.Atoi(val); err == nil && seconds >= 0 {
+				maxAge = time.Duration(seconds) * time.Second
+			}
+		}
+		return strings.Trim(alt, `"`), maxAge, true
+	}
+	return "", 0, false
+}
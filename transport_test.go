@@ -0,0 +1,281 @@
+package https
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/require"
+)
+
+type mockRoundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f mockRoundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// newDoHTestHandler returns an HTTP handler that replies with the expected DNS message
+// and stores the HTTP protocol major version of the last request.
+func newDoHTestHandler(t *testing.T, protoMajor *int32) http.HandlerFunc {
+	t.Helper()
+	return func(w http.ResponseWriter, r *http.Request) {
+		atomic.StoreInt32(protoMajor, int32(r.ProtoMajor))
+		w.Header().Set("Content-Type", dnsMessageMimeType)
+		_, err := w.Write(packMsg(t, newExpectedDNSMsg()))
+		require.NoError(t, err)
+	}
+}
+
+// startH3TestServer starts an in-process HTTP/3 server that uses the certificate of the given TLS server
+// and returns its address.
+func startH3TestServer(t *testing.T, tlsSrv *httptest.Server, handler http.Handler) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := &http3.Server{
+		Handler:   handler,
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: tlsSrv.TLS.Certificates}),
+	}
+	go func() {
+		_ = srv.Serve(conn)
+	}()
+	t.Cleanup(func() {
+		srv.Close()
+		conn.Close()
+	})
+	return conn.LocalAddr().String()
+}
+
+func testClientTLSConfig(tlsSrv *httptest.Server) *tls.Config {
+	return &tls.Config{RootCAs: tlsSrv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs}
+}
+
+func TestH3Transport(t *testing.T) {
+	var protoMajor int32
+	handler := newDoHTestHandler(t, &protoMajor)
+	tlsSrv := httptest.NewTLSServer(handler)
+	defer tlsSrv.Close()
+	h3Addr := startH3TestServer(t, tlsSrv, handler)
+
+	tr := newHTTPTransport(transportH3, testClientTLSConfig(tlsSrv), nil)
+	defer closeTransport(tr)
+	dnsClient := newDoHDNSClient(&http.Client{Transport: tr}, "https://"+h3Addr+"/dns-query")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := dnsClient.Query(ctx, packMsg(t, newRequestDNSMsg()))
+	require.NoError(t, err)
+	require.Equal(t, newExpectedDNSMsg().Answer[0].String(), result.Answer[0].String())
+	require.Equal(t, int32(3), atomic.LoadInt32(&protoMajor), "request must be sent over HTTP/3")
+}
+
+func TestAutoTransportAltSvc(t *testing.T) {
+	var protoMajor int32
+	handler := newDoHTestHandler(t, &protoMajor)
+
+	var h3Port string
+	tlsSrv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Alt-Svc", `h3=":`+h3Port+`"; ma=3600`)
+		handler(w, r)
+	}))
+	tlsSrv.EnableHTTP2 = true
+	tlsSrv.StartTLS()
+	defer tlsSrv.Close()
+	h3Addr := startH3TestServer(t, tlsSrv, handler)
+	_, h3Port, _ = net.SplitHostPort(h3Addr)
+
+	tr := newHTTPTransport(transportAuto, testClientTLSConfig(tlsSrv), nil)
+	defer closeTransport(tr)
+	dnsClient := newDoHDNSClient(&http.Client{Transport: tr}, tlsSrv.URL+"/dns-query")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := dnsClient.Query(ctx, packMsg(t, newRequestDNSMsg()))
+	require.NoError(t, err)
+	require.Equal(t, int32(2), atomic.LoadInt32(&protoMajor), "first request must be sent over HTTP/2")
+
+	_, err = dnsClient.Query(ctx, packMsg(t, newRequestDNSMsg()))
+	require.NoError(t, err)
+	require.Equal(t, int32(3), atomic.LoadInt32(&protoMajor), "request must be upgraded to HTTP/3")
+}
+
+func TestAutoTransportAltSvcOtherHost(t *testing.T) {
+	var protoMajor int32
+	handler := newDoHTestHandler(t, &protoMajor)
+
+	var h3Port string
+	tlsSrv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the test certificate is valid for 127.0.0.1, but not for localhost
+		w.Header().Set("Alt-Svc", `h3="localhost:`+h3Port+`"; ma=3600`)
+		handler(w, r)
+	}))
+	tlsSrv.EnableHTTP2 = true
+	tlsSrv.StartTLS()
+	defer tlsSrv.Close()
+	h3Addr := startH3TestServer(t, tlsSrv, handler)
+	_, h3Port, _ = net.SplitHostPort(h3Addr)
+
+	tr := newHTTPTransport(transportAuto, testClientTLSConfig(tlsSrv), nil)
+	defer closeTransport(tr)
+	dnsClient := newDoHDNSClient(&http.Client{Transport: tr}, tlsSrv.URL+"/dns-query")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := dnsClient.Query(ctx, packMsg(t, newRequestDNSMsg()))
+	require.NoError(t, err)
+	require.Equal(t, int32(2), atomic.LoadInt32(&protoMajor), "first request must be sent over HTTP/2")
+
+	// the certificate of the alternative service is verified for the origin host
+	_, err = dnsClient.Query(ctx, packMsg(t, newRequestDNSMsg()))
+	require.NoError(t, err)
+	require.Equal(t, int32(3), atomic.LoadInt32(&protoMajor), "request must be upgraded to HTTP/3")
+}
+
+func TestAltSvcRoundTripperDialAlt(t *testing.T) {
+	tr := newAltSvcRoundTripper(nil, nil)
+	tr.update("example.com:443", `h3="alt.example.com:8443"`)
+
+	var dialed string
+	dial := tr.dialAlt(func(_ context.Context, addr string, _ *tls.Config, _ *quic.Config) (quic.EarlyConnection, error) {
+		dialed = addr
+		return nil, errors.New("quic error")
+	})
+	_, err := dial(context.Background(), "example.com:443", &tls.Config{ServerName: "example.com"}, nil)
+	require.Error(t, err)
+	require.Equal(t, "alt.example.com:8443", dialed)
+
+	_, err = dial(context.Background(), "example.org:443", nil, nil)
+	require.ErrorIs(t, err, errNoAltSvc)
+}
+
+func TestOriginAuthority(t *testing.T) {
+	for rawURL, expected := range map[string]string{
+		"https://example.com/dns-query":      "example.com:443",
+		"https://example.com:8443/dns-query": "example.com:8443",
+		"http://example.com/dns-query":       "example.com:80",
+		"https://[::1]/dns-query":            "[::1]:443",
+	} {
+		u, err := url.Parse(rawURL)
+		require.NoError(t, err)
+		require.Equal(t, expected, originAuthority(u), rawURL)
+	}
+}
+
+func TestAltSvcRoundTripperFallback(t *testing.T) {
+	h2CallCount, h3CallCount := 0, 0
+	h2 := mockRoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		h2CallCount++
+		require.Equal(t, "example.com", req.URL.Host)
+		buf, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		require.Equal(t, []byte("abc"), buf, "invalid request body")
+
+		resp := &http.Response{
+			Header:     http.Header{"Alt-Svc": []string{`h3=":8443"`}},
+			Body:       http.NoBody,
+			StatusCode: http.StatusOK,
+		}
+		return resp, nil
+	})
+	h3 := mockRoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		h3CallCount++
+		require.Equal(t, "example.com", req.URL.Host, "the origin of the request must remain the same")
+		buf, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		require.Equal(t, []byte("abc"), buf, "invalid request body")
+		return nil, errors.New("quic error")
+	})
+	tr := newAltSvcRoundTripper(h2, h3)
+
+	for i, expected := range []struct{ h2, h3 int }{{1, 0}, {2, 1}, {3, 1}} {
+		req, err := http.NewRequest(http.MethodPost, "https://example.com/dns-query", bytes.NewReader([]byte("abc")))
+		require.NoError(t, err)
+		_, err = tr.RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, expected.h2, h2CallCount, "iteration %d", i)
+		require.Equal(t, expected.h3, h3CallCount, "iteration %d", i)
+	}
+}
+
+func TestAltSvcRoundTripperClear(t *testing.T) {
+	altSvcHeader := `h3=":443"`
+	h2 := mockRoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		resp := &http.Response{
+			Header:     http.Header{"Alt-Svc": []string{altSvcHeader}},
+			Body:       http.NoBody,
+			StatusCode: http.StatusOK,
+		}
+		return resp, nil
+	})
+	tr := newAltSvcRoundTripper(h2, nil)
+
+	req, err := http.NewRequest(http.MethodGet, "https://example.com/dns-query", http.NoBody)
+	require.NoError(t, err)
+	_, err = tr.RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, "example.com:443", tr.lookup("example.com:443"))
+
+	altSvcHeader = "clear"
+	tr.update("example.com:443", altSvcHeader)
+	require.Empty(t, tr.lookup("example.com:443"))
+}
+
+func TestParseAltSvcH3(t *testing.T) {
+	tests := []struct {
+		name              string
+		header            string
+		expectedAuthority string
+		expectedMaxAge    time.Duration
+		expectedOK        bool
+	}{
+		{
+			name:              "SamePort",
+			header:            `h3=":443"`,
+			expectedAuthority: ":443",
+			expectedMaxAge:    defaultAltSvcMaxAge,
+			expectedOK:        true,
+		},
+		{
+			name:              "MaxAge",
+			header:            `h3=":443"; ma=3600`,
+			expectedAuthority: ":443",
+			expectedMaxAge:    time.Hour,
+			expectedOK:        true,
+		},
+		{
+			name:              "OtherHost",
+			header:            `h2=":443", h3="alt.example.com:8443"; persist=1; ma=60`,
+			expectedAuthority: "alt.example.com:8443",
+			expectedMaxAge:    time.Minute,
+			expectedOK:        true,
+		},
+		{
+			name:   "NoH3",
+			header: `h2=":443"; ma=3600, h3-29=":443"`,
+		},
+		{
+			name:   "Clear",
+			header: "clear",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authority, maxAge, ok := parseAltSvcH3(tt.header)
+			require.Equal(t, tt.expectedOK, ok)
+			require.Equal(t, tt.expectedAuthority, authority)
+			require.Equal(t, tt.expectedMaxAge, maxAge)
+		})
+	}
+}
@@ -0,0 +1,24 @@
+package https
+
+import (
+	"net"
+)
+
+// clientView is a group of upstreams that serves queries of clients from its networks.
+type clientView struct {
+	nets   []*net.IPNet
+	client dnsClient
+}
+
+func newClientView(nets []*net.IPNet, client dnsClient) *clientView {
+	return &clientView{nets: nets, client: client}
+}
+
+func (v *clientView) match(ip net.IP) bool {
+	for _, n := range v.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
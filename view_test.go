@@ -0,0 +1,65 @@
+package https
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func mustParseCIDRs(t *testing.T, cidrs ...string) []*net.IPNet {
+	t.Helper()
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		var err error
+		nets[i], err = parseCIDR(cidr)
+		require.NoError(t, err)
+	}
+	return nets
+}
+
+func TestClientViewMatch(t *testing.T) {
+	v := newClientView(mustParseCIDRs(t, "192.168.100.0/24", "10.10.0.0/16", "2001:db8::/32", "172.16.0.1"), nil)
+
+	require.True(t, v.match(net.ParseIP("192.168.100.7")))
+	require.True(t, v.match(net.ParseIP("10.10.200.1")))
+	require.True(t, v.match(net.ParseIP("2001:db8::1")))
+	require.True(t, v.match(net.ParseIP("172.16.0.1")))
+	require.False(t, v.match(net.ParseIP("172.16.0.2")))
+	require.False(t, v.match(net.ParseIP("192.168.101.7")))
+	require.False(t, v.match(net.ParseIP("2001:db9::1")))
+	require.False(t, v.match(nil))
+}
+
+func TestHTTPSViews(t *testing.T) {
+	var calls []string
+	h := newHTTPS(".", newNamedDNSClient("default", &calls), withViews([]*clientView{
+		newClientView(mustParseCIDRs(t, "192.168.100.0/24"), newNamedDNSClient("guest", &calls)),
+		newClientView(mustParseCIDRs(t, "10.10.0.0/16", "192.168.0.0/16"), newNamedDNSClient("servers", &calls)),
+	}))
+
+	tests := []struct {
+		name     string
+		remoteIP string
+		expected string
+	}{
+		{name: "FirstView", remoteIP: "192.168.100.7", expected: "guest"},
+		{name: "SecondView", remoteIP: "10.10.1.1", expected: "servers"},
+		{name: "FirstMatchingView", remoteIP: "192.168.1.1", expected: "servers"},
+		{name: "Default", remoteIP: "172.16.0.1", expected: "default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls = nil
+			rec := dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: tt.remoteIP})
+			_, err := h.ServeDNS(context.Background(), rec, newRequestDNSMsg())
+			require.NoError(t, err)
+			require.Equal(t, dns.RcodeSuccess, rec.Rcode)
+			require.Equal(t, []string{tt.expected}, calls)
+		})
+	}
+}